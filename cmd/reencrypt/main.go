@@ -0,0 +1,47 @@
+// Reencrypt encrypts the queued requests with the active key.
+// Run it after adding a new key to the top of the key list
+// and remove the old key once it's done.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/worker"
+)
+
+var (
+	configDir = flag.String("config", ".", "directory with config.yaml")
+	batchSize = flag.Int("batch", 100, "number of requests to reencrypt in one transaction")
+)
+
+func main() {
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	queue, err := worker.NewPgQueue(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	total, err := queue.Reencrypt(ctx, *batchSize)
+	if err != nil {
+		log.WithField("total", total).Fatal(err)
+	}
+
+	log.WithField("total", total).Info("Reencryption done!")
+}
@@ -14,30 +14,287 @@ type Config struct {
 		ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
 		EnqueueEnabled  bool          `mapstructure:"enqueue_enabled"`
 		EnqueueRate     int           `mapstructure:"enqueue_rate"`
+		EnqueuePolicy   EnqueuePolicy `mapstructure:"enqueue_policy"`
+		MaxBodySize     int64         `mapstructure:"max_body_size"`
+		StreamBuffer    int           `mapstructure:"stream_buffer"`
+		StreamTempDir   string        `mapstructure:"stream_temp_dir"`
+		Shedding        Shedding      `mapstructure:"shedding"`
+		TLS             TLS           `mapstructure:"tls"`
 	} `mapstructure:"server"`
 
 	Metrics struct {
 		Bind string `mapstructure:"bind"`
 		Path string `mapstructure:"path"`
+		TLS  TLS    `mapstructure:"tls"`
 	} `mapstructure:"metrics"`
 
 	Proxy struct {
 		RemoteUrl      string        `mapstructure:"remote_url"`
 		RequestTimeout time.Duration `mapstructure:"request_timeout"`
 		NumClients     int           `mapstructure:"num_clients"`
+		TLS            ClientTLS     `mapstructure:"tls"`
+		OAuth2         OAuth2        `mapstructure:"oauth2"`
+		Limits         Limits        `mapstructure:"limits"`
 	} `mapstructure:"proxy"`
 
+	Upstreams []Upstream `mapstructure:"upstreams"`
+
 	Queue struct {
-		Workers         int `mapstructure:"workers"`
-		HandlePerSecond int `mapstructure:"handle_per_second"`
-		MaxRetries      int `mapstructure:"max_retries"`
+		Workers         int         `mapstructure:"workers"`
+		HandlePerSecond int         `mapstructure:"handle_per_second"`
+		MaxRetries      int         `mapstructure:"max_retries"`
+		RetryBudget     RetryBudget `mapstructure:"retry_budget"`
+		Compression     Compression `mapstructure:"compression"`
+		Encryption      Encryption  `mapstructure:"encryption"`
+		Blob            Blob        `mapstructure:"blob"`
 	} `mapstructure:"queue"`
 
 	Db struct {
-		ConnectionString string `mapstructure:"connection_string"`
-		MaxConnections   int    `mapstructure:"max_connections"`
-		UseIndex         bool   `mapstructure:"use_index"`
+		ConnectionString string       `mapstructure:"connection_string"`
+		MaxConnections   int          `mapstructure:"max_connections"`
+		UseIndex         bool         `mapstructure:"use_index"`
+		Partitioning     Partitioning `mapstructure:"partitioning"`
 	} `mapstructure:"db"`
+
+	Auth struct {
+		Header     string   `mapstructure:"header"`
+		QueryParam string   `mapstructure:"query_param"`
+		Keys       []APIKey `mapstructure:"keys"`
+	} `mapstructure:"auth"`
+
+	Routes []Route `mapstructure:"routes"`
+
+	Filters []Filter `mapstructure:"filters"`
+
+	Tenants Tenants `mapstructure:"tenants"`
+}
+
+type Compression struct {
+	MinSize int  `mapstructure:"min_size"`
+	Level   int  `mapstructure:"level"`
+	Headers bool `mapstructure:"headers"`
+}
+
+type Encryption struct {
+	KeyFile   string `mapstructure:"key_file"`
+	KeyEnv    string `mapstructure:"key_env"`
+	ActiveKey string `mapstructure:"active_key"`
+}
+
+type RetryBudget struct {
+	Ratio      float64       `mapstructure:"ratio"`
+	MinRetries int           `mapstructure:"min_retries"`
+	Window     time.Duration `mapstructure:"window"`
+	Defer      time.Duration `mapstructure:"defer"`
+}
+
+type EnqueuePolicy struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Window       time.Duration `mapstructure:"window"`
+	MinRequests  int           `mapstructure:"min_requests"`
+	LatencyP95   time.Duration `mapstructure:"latency_p95"`
+	ErrorRate    float64       `mapstructure:"error_rate"`
+	QueueDepth   uint64        `mapstructure:"queue_depth"`
+	RecoverRatio float64       `mapstructure:"recover_ratio"`
+	Hold         time.Duration `mapstructure:"hold"`
+}
+
+type Shedding struct {
+	QueueDepth uint64        `mapstructure:"queue_depth"`
+	OldestAge  time.Duration `mapstructure:"oldest_age"`
+	Action     string        `mapstructure:"action"`
+	RetryAfter time.Duration `mapstructure:"retry_after"`
+}
+
+type Partitioning struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Interval time.Duration `mapstructure:"interval"`
+	Premake  int           `mapstructure:"premake"`
+}
+
+type Blob struct {
+	Type       string        `mapstructure:"type"`
+	MinSize    int           `mapstructure:"min_size"`
+	Dir        string        `mapstructure:"dir"`
+	S3         S3            `mapstructure:"s3"`
+	GCInterval time.Duration `mapstructure:"gc_interval"`
+	GCGrace    time.Duration `mapstructure:"gc_grace"`
+}
+
+type S3 struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	Bucket          string `mapstructure:"bucket"`
+	Prefix          string `mapstructure:"prefix"`
+	Region          string `mapstructure:"region"`
+	PathStyle       bool   `mapstructure:"path_style"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+}
+
+type Filter struct {
+	Name     string   `mapstructure:"name"`
+	Expr     string   `mapstructure:"expr"`
+	Action   string   `mapstructure:"action"`
+	Response Response `mapstructure:"response"`
+	Route    string   `mapstructure:"route"`
+	Tags     []string `mapstructure:"tags"`
+}
+
+type APIKey struct {
+	Producer   string `mapstructure:"producer"`
+	Key        string `mapstructure:"key"`
+	Rate       int    `mapstructure:"rate"`
+	Burst      int    `mapstructure:"burst"`
+	DailyQuota int    `mapstructure:"daily_quota"`
+}
+
+type Tenants struct {
+	Source  string        `mapstructure:"source"`
+	Header  string        `mapstructure:"header"`
+	Default string        `mapstructure:"default"`
+	Rate    int           `mapstructure:"rate"`
+	Burst   int           `mapstructure:"burst"`
+	Limits  []TenantLimit `mapstructure:"limits"`
+}
+
+type TenantLimit struct {
+	Tenant string `mapstructure:"tenant"`
+	Rate   int    `mapstructure:"rate"`
+	Burst  int    `mapstructure:"burst"`
+	Weight int    `mapstructure:"weight"`
+}
+
+type TLS struct {
+	CertFile     string `mapstructure:"cert_file"`
+	KeyFile      string `mapstructure:"key_file"`
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	ClientAuth   string `mapstructure:"client_auth"`
+}
+
+type ClientTLS struct {
+	CAFile     string `mapstructure:"ca_file"`
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+	ServerName string `mapstructure:"server_name"`
+	MinVersion string `mapstructure:"min_version"`
+}
+
+type Upstream struct {
+	Name      string    `mapstructure:"name"`
+	RemoteUrl string    `mapstructure:"remote_url"`
+	TLS       ClientTLS `mapstructure:"tls"`
+	OAuth2    OAuth2    `mapstructure:"oauth2"`
+	Limits    Limits    `mapstructure:"limits"`
+}
+
+type Limits struct {
+	Rate           int      `mapstructure:"rate"`
+	Burst          int      `mapstructure:"burst"`
+	MaxConcurrency int      `mapstructure:"max_concurrency"`
+	Adaptive       Adaptive `mapstructure:"adaptive"`
+}
+
+type Adaptive struct {
+	Enabled   bool    `mapstructure:"enabled"`
+	Min       int     `mapstructure:"min"`
+	Initial   int     `mapstructure:"initial"`
+	Tolerance float64 `mapstructure:"tolerance"`
+	Backoff   float64 `mapstructure:"backoff"`
+}
+
+type OAuth2 struct {
+	TokenURL     string        `mapstructure:"token_url"`
+	ClientID     string        `mapstructure:"client_id"`
+	ClientSecret string        `mapstructure:"client_secret"`
+	Scopes       []string      `mapstructure:"scopes"`
+	Audience     string        `mapstructure:"audience"`
+	ExpiryDelta  time.Duration `mapstructure:"expiry_delta"`
+}
+
+type Route struct {
+	Name     string `mapstructure:"name"`
+	Path     string `mapstructure:"path"`
+	Mode     string `mapstructure:"mode"`
+	Upstream string `mapstructure:"upstream"`
+	Stream   bool   `mapstructure:"stream"`
+
+	Response  Response  `mapstructure:"response"`
+	Verify    Verify    `mapstructure:"verify"`
+	Sign      Sign      `mapstructure:"sign"`
+	Headers   Headers   `mapstructure:"headers"`
+	Rewrite   Rewrite   `mapstructure:"rewrite"`
+	Transform Transform `mapstructure:"transform"`
+	Validate  Validate  `mapstructure:"validate"`
+	Shedding  Shedding  `mapstructure:"shedding"`
+}
+
+type Validate struct {
+	MaxBodySize  int64    `mapstructure:"max_body_size"`
+	Methods      []string `mapstructure:"methods"`
+	ContentTypes []string `mapstructure:"content_types"`
+	Schema       string   `mapstructure:"schema"`
+}
+
+type Transform struct {
+	Stage string          `mapstructure:"stage"`
+	Steps []TransformStep `mapstructure:"steps"`
+}
+
+type TransformStep struct {
+	Type        string         `mapstructure:"type"`
+	Fields      []FieldMapping `mapstructure:"fields"`
+	Template    string         `mapstructure:"template"`
+	ContentType string         `mapstructure:"content_type"`
+}
+
+type FieldMapping struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+type Rewrite struct {
+	StripPrefix string         `mapstructure:"strip_prefix"`
+	AddPrefix   string         `mapstructure:"add_prefix"`
+	Regex       []RegexRewrite `mapstructure:"regex"`
+	AddQuery    []QueryParam   `mapstructure:"add_query"`
+	RemoveQuery []string       `mapstructure:"remove_query"`
+}
+
+type RegexRewrite struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+}
+
+type QueryParam struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+type Headers struct {
+	Remove []string          `mapstructure:"remove"`
+	Rename map[string]string `mapstructure:"rename"`
+	Set    map[string]string `mapstructure:"set"`
+	Append map[string]string `mapstructure:"append"`
+}
+
+type Response struct {
+	Status  int               `mapstructure:"status"`
+	Headers map[string]string `mapstructure:"headers"`
+	Body    string            `mapstructure:"body"`
+}
+
+type Sign struct {
+	Secret string `mapstructure:"secret"`
+	Header string `mapstructure:"header"`
+}
+
+type Verify struct {
+	Type      string        `mapstructure:"type"`
+	Secret    string        `mapstructure:"secret"`
+	Header    string        `mapstructure:"header"`
+	Prefix    string        `mapstructure:"prefix"`
+	Encoding  string        `mapstructure:"encoding"`
+	Tolerance time.Duration `mapstructure:"tolerance"`
 }
 
 func LoadConfig(path string) (*Config, error) {
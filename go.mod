@@ -3,11 +3,13 @@ module github.com/evilmartians/asyncproxy
 go 1.20
 
 require (
+	github.com/expr-lang/expr v1.16.9
 	github.com/google/uuid v1.3.0
 	github.com/jpillora/backoff v1.0.0
 	github.com/lib/pq v1.10.3
 	github.com/pressly/goose v2.7.0+incompatible
 	github.com/prometheus/client_golang v1.11.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.9.0
 	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11
@@ -0,0 +1,181 @@
+// Package apikey authenticates the producers of the incoming requests
+package apikey
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const defaultHeader = "Authorization"
+
+var (
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrRateLimited   = errors.New("rate limit exceeded")
+	ErrQuotaExceeded = errors.New("daily quota exceeded")
+)
+
+// Authenticator finds the producer by the API key
+// and checks the producer limits
+type Authenticator struct {
+	header     string
+	queryParam string
+
+	// Keys are stored hashed so the lookup time doesn't depend
+	// on the key prefix
+	producers map[[sha256.Size]byte]*producer
+
+	now func() time.Time
+}
+
+type producer struct {
+	name    string
+	limiter *rate.Limiter
+	quota   int
+
+	mu   sync.Mutex
+	day  string
+	used int
+}
+
+// NewAuthenticator returns nil if no API keys configured
+func NewAuthenticator(config *cfg.Config) *Authenticator {
+	a, err := newAuthenticator(config.Auth.Header, config.Auth.QueryParam, config.Auth.Keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if a != nil {
+		log.WithFields(log.Fields{
+			"header":      a.header,
+			"query_param": a.queryParam,
+			"producers":   len(a.producers),
+		}).Info("Initializing API keys")
+	}
+
+	return a
+}
+
+func newAuthenticator(header, queryParam string, keys []cfg.APIKey) (*Authenticator, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if header == "" {
+		header = defaultHeader
+	}
+
+	a := &Authenticator{
+		header:     http.CanonicalHeaderKey(header),
+		queryParam: queryParam,
+		producers:  make(map[[sha256.Size]byte]*producer, len(keys)),
+		now:        time.Now,
+	}
+
+	for i, key := range keys {
+		if key.Producer == "" || key.Key == "" {
+			return nil, fmt.Errorf("api key #%d: producer and key are required", i)
+		}
+
+		hash := sha256.Sum256([]byte(key.Key))
+		if _, ok := a.producers[hash]; ok {
+			return nil, fmt.Errorf("api key #%d: duplicate key", i)
+		}
+
+		p := &producer{name: key.Producer, quota: key.DailyQuota}
+		if key.Rate > 0 {
+			burst := key.Burst
+			if burst < 1 {
+				burst = key.Rate
+			}
+
+			p.limiter = rate.NewLimiter(rate.Limit(key.Rate), burst)
+		}
+
+		a.producers[hash] = p
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the producer name for the request API key.
+// The key is removed from the request so it is not proxied further.
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	key := a.extractKey(r)
+	if key == "" {
+		return "", ErrUnauthorized
+	}
+
+	p, ok := a.producers[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", ErrUnauthorized
+	}
+
+	if p.limiter != nil && !p.limiter.Allow() {
+		return p.name, ErrRateLimited
+	}
+
+	if !p.take(a.now()) {
+		return p.name, ErrQuotaExceeded
+	}
+
+	return p.name, nil
+}
+
+func (a *Authenticator) extractKey(r *http.Request) string {
+	if value := r.Header.Get(a.header); value != "" {
+		r.Header.Del(a.header)
+
+		if a.header == defaultHeader {
+			return strings.TrimSpace(strings.TrimPrefix(value, "Bearer "))
+		}
+
+		return value
+	}
+
+	if a.queryParam == "" {
+		return ""
+	}
+
+	query := r.URL.Query()
+	value := query.Get(a.queryParam)
+	if value != "" {
+		query.Del(a.queryParam)
+		r.URL.RawQuery = query.Encode()
+	}
+
+	return value
+}
+
+// Counts the request against the daily quota, resets at midnight UTC
+func (p *producer) take(now time.Time) bool {
+	if p.quota < 1 {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	day := now.UTC().Format("2006-01-02")
+	if day != p.day {
+		p.day = day
+		p.used = 0
+	}
+
+	if p.used >= p.quota {
+		return false
+	}
+
+	p.used++
+
+	return true
+}
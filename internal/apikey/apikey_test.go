@@ -0,0 +1,88 @@
+package apikey
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	a, err := newAuthenticator("", "api_key", []cfg.APIKey{
+		{Producer: "billing", Key: "billing-key"},
+		{Producer: "crm", Key: "crm-key"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "/hooks", nil)
+	r.Header.Set("Authorization", "Bearer billing-key")
+	if producer, err := a.Authenticate(r); err != nil || producer != "billing" {
+		t.Errorf("expected billing producer: %s, %v", producer, err)
+	}
+	if r.Header.Get("Authorization") != "" {
+		t.Errorf("expected API key header to be removed")
+	}
+
+	r = httptest.NewRequest("POST", "/hooks?api_key=crm-key&id=1", nil)
+	if producer, err := a.Authenticate(r); err != nil || producer != "crm" {
+		t.Errorf("expected crm producer: %s, %v", producer, err)
+	}
+	if r.URL.RawQuery != "id=1" {
+		t.Errorf("expected API key query param to be removed: %s", r.URL.RawQuery)
+	}
+
+	r = httptest.NewRequest("POST", "/hooks", nil)
+	r.Header.Set("Authorization", "Bearer unknown")
+	if _, err := a.Authenticate(r); err != ErrUnauthorized {
+		t.Errorf("expected unknown key to be rejected: %v", err)
+	}
+
+	r = httptest.NewRequest("POST", "/hooks", nil)
+	if _, err := a.Authenticate(r); err != ErrUnauthorized {
+		t.Errorf("expected missing key to be rejected: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	a, err := newAuthenticator("X-Api-Key", "", []cfg.APIKey{
+		{Producer: "limited", Key: "rate", Rate: 1, Burst: 1},
+		{Producer: "quoted", Key: "quota", DailyQuota: 2},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	request := func(key string) error {
+		r := httptest.NewRequest("POST", "/hooks", nil)
+		r.Header.Set("X-Api-Key", key)
+		_, err := a.Authenticate(r)
+		return err
+	}
+
+	if err := request("rate"); err != nil {
+		t.Errorf("expected first request to pass: %s", err)
+	}
+	if err := request("rate"); err != ErrRateLimited {
+		t.Errorf("expected second request to be rate limited: %v", err)
+	}
+
+	day := time.Date(2021, 11, 1, 23, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return day }
+
+	for i := 0; i < 2; i++ {
+		if err := request("quota"); err != nil {
+			t.Errorf("expected request within quota to pass: %s", err)
+		}
+	}
+	if err := request("quota"); err != ErrQuotaExceeded {
+		t.Errorf("expected quota to be exceeded: %v", err)
+	}
+
+	day = day.Add(2 * time.Hour)
+	if err := request("quota"); err != nil {
+		t.Errorf("expected quota to be reset the next day: %s", err)
+	}
+}
@@ -0,0 +1,47 @@
+// Package blob stores the large request bodies outside of the database
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	TypeFS = "fs"
+	TypeS3 = "s3"
+
+	// Number of the keys passed to the List callback at once
+	listPageSize = 1000
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps the blobs by their keys
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Delete succeeds if the blob doesn't exist
+	Delete(ctx context.Context, key string) error
+
+	// List calls fn with the pages of the keys stored before the time
+	List(ctx context.Context, before time.Time, fn func(keys []string) error) error
+}
+
+// New returns nil if the store is not configured
+func New(config cfg.Blob) (Store, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case TypeFS:
+		return NewFS(config.Dir)
+	case TypeS3:
+		return NewS3(config.S3)
+	}
+
+	return nil, fmt.Errorf("unknown blob store type %q", config.Type)
+}
@@ -0,0 +1,77 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+
+	ctx := context.Background()
+	data := []byte{0, 1, 2, 0xff}
+
+	if err := s.Put(ctx, "request-1", data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	stored, err := s.Get(ctx, "request-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Errorf("expected the same blob: %v", stored)
+	}
+
+	var listed []string
+	list := func(keys []string) error {
+		listed = append(listed, keys...)
+		return nil
+	}
+
+	if err = s.List(ctx, time.Now().Add(time.Minute), list); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(listed) != 1 || listed[0] != "request-1" {
+		t.Errorf("expected the stored key to be listed: %v", listed)
+	}
+
+	listed = nil
+	if err = s.List(ctx, time.Now().Add(-time.Minute), list); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(listed) != 0 {
+		t.Errorf("expected the newer keys not to be listed: %v", listed)
+	}
+
+	if err = s.Delete(ctx, "request-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = s.Delete(ctx, "request-1"); err != nil {
+		t.Errorf("expected deleting missing blob to succeed: %s", err)
+	}
+
+	if _, err = s.Get(ctx, "request-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	s, err := New(cfg.Blob{Type: TypeFS, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testStore(t, s)
+
+	for _, key := range []string{"", "../etc/passwd", ".tmp-1", "a/b"} {
+		if err = s.Put(context.Background(), key, nil); err == nil {
+			t.Errorf("%q: expected invalid key to be rejected", key)
+		}
+	}
+}
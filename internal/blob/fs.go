@@ -0,0 +1,119 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FS stores the blobs as files in the directory
+type FS struct {
+	dir string
+}
+
+func NewFS(dir string) (*FS, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("blob directory is required")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &FS{dir: dir}, nil
+}
+
+// Writes to a temporary file first, so the blob never gets read half-written
+func (s *FS) Put(_ context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FS) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	return data, err
+}
+
+func (s *FS) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Skips the temporary files being written
+func (s *FS) List(_ context.Context, before time.Time, fn func([]string) error) error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, listPageSize)
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !f.ModTime().Before(before) {
+			continue
+		}
+
+		keys = append(keys, f.Name())
+		if len(keys) == listPageSize {
+			if err = fn(keys); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return fn(keys)
+}
+
+// Keys are file names, the nested paths are not allowed
+func (s *FS) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	return filepath.Join(s.dir, key), nil
+}
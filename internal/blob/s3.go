@@ -0,0 +1,271 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	s3Timeout     = 30 * time.Second
+
+	amzDateFormat = "20060102T150405Z"
+)
+
+// S3 stores the blobs in the S3-compatible storage,
+// requests are signed with AWS Signature Version 4
+type S3 struct {
+	client *http.Client
+
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+
+	accessKeyID     string
+	secretAccessKey string
+
+	now func() time.Time
+}
+
+func NewS3(config cfg.S3) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("s3 endpoint must start with http(s)://: %s", config.Endpoint)
+	}
+
+	s := &S3{
+		client:          &http.Client{Timeout: s3Timeout},
+		endpoint:        endpoint,
+		bucket:          config.Bucket,
+		prefix:          config.Prefix,
+		region:          config.Region,
+		pathStyle:       config.PathStyle,
+		accessKeyID:     config.AccessKeyID,
+		secretAccessKey: config.SecretAccessKey,
+		now:             time.Now,
+	}
+
+	if s.region == "" {
+		s.region = defaultRegion
+	}
+
+	return s, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, data []byte) error {
+	res, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return s3Error(res, http.StatusOK)
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err = s3Error(res, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Deleting the missing object is not an error in S3
+	return s3Error(res, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+}
+
+// Lists the objects with ListObjectsV2 a page at a time:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+func (s *S3) List(ctx context.Context, before time.Time, fn func([]string) error) error {
+	query := url.Values{"list-type": {"2"}}
+	if s.prefix != "" {
+		query.Set("prefix", s.prefix)
+	}
+
+	for {
+		res, err := s.request(ctx, http.MethodGet, "/", query, nil)
+		if err != nil {
+			return err
+		}
+
+		var result listBucketResult
+		if err = s3Error(res, http.StatusOK); err == nil {
+			err = xml.NewDecoder(res.Body).Decode(&result)
+		}
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(result.Contents))
+		for _, object := range result.Contents {
+			if object.LastModified.Before(before) {
+				keys = append(keys, strings.TrimPrefix(object.Key, s.prefix))
+			}
+		}
+
+		if len(keys) > 0 {
+			if err = fn(keys); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Page of the ListObjectsV2 response
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	return s.request(ctx, method, "/"+s.prefix+key, nil, body)
+}
+
+// Sends the request to the path in the bucket
+func (s *S3) request(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	objectURL := *s.endpoint
+	objectURL.RawQuery = encodeQuery(query)
+
+	if s.pathStyle {
+		objectURL.Path = "/" + s.bucket + path
+	} else {
+		objectURL.Host = s.bucket + "." + s.endpoint.Host
+		objectURL.Path = path
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	s.sign(req, body)
+
+	return s.client.Do(req)
+}
+
+// Signs the request with the host, x-amz-* and the other set headers:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		encodeQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// Sorted query with the spaces as %20 as the signature requires
+func encodeQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func s3Error(res *http.Response, expected ...int) error {
+	for _, status := range expected {
+		if res.StatusCode == status {
+			return nil
+		}
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+
+	return fmt.Errorf("s3 %s %s: %d %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, message)
+}
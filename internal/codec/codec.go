@@ -0,0 +1,280 @@
+// Package codec encodes the request payloads stored in the queue
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	// Stored as is, the rows enqueued before the formats were introduced
+	FormatPlain = 0
+
+	// The compression algorithm byte followed by the data
+	FormatV1 = 1
+
+	// The nonce followed by the FormatV1 payload encrypted
+	// with the row data key
+	FormatV2 = 2
+
+	dataKeySize = 32
+)
+
+// Compression algorithms of the payloads
+const (
+	compressionNone byte = iota
+	compressionGzip
+)
+
+// Codec compresses the payloads above the size threshold
+// and encrypts them if the keys are configured
+type Codec struct {
+	// Compress the headers as well as the bodies
+	Headers bool
+
+	minSize int
+	level   int
+
+	// Nil if the encryption is disabled
+	keys *Keyring
+}
+
+// Payload is the stored representation of the request header and body
+type Payload struct {
+	Header       []byte
+	Body         []byte
+	HeaderFormat int
+	BodyFormat   int
+
+	// Master key ID and the base64 of the data key encrypted with it,
+	// empty if the payload is not encrypted
+	KeyID   string
+	DataKey []byte
+}
+
+// New returns the codec storing everything as is if neither
+// the compression threshold nor the encryption keys are configured
+func New(compression cfg.Compression, encryption cfg.Encryption) (*Codec, error) {
+	c := &Codec{
+		Headers: compression.Headers,
+		minSize: compression.MinSize,
+		level:   compression.Level,
+	}
+
+	if c.level == 0 {
+		c.level = gzip.DefaultCompression
+	}
+
+	// Fail early on the invalid level
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, c.level); err != nil {
+		return nil, err
+	}
+
+	keys, err := loadKeyring(encryption)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %s", err)
+	}
+	c.keys = keys
+
+	return c, nil
+}
+
+// Encrypted reports whether the new payloads are encrypted
+// and returns the active key ID
+func (c *Codec) Encrypted() (string, bool) {
+	if c.keys == nil {
+		return "", false
+	}
+
+	return c.keys.Active(), true
+}
+
+// Encode prepares the payload of the request with the id for storing.
+// The id is authenticated along with the encrypted data, so the payload
+// can't be moved to another row.
+func (c *Codec) Encode(id string, header, body []byte) (*Payload, error) {
+	p := &Payload{}
+
+	var dataKey []byte
+	if c.keys != nil {
+		dataKey = make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+
+		keyID, wrapped, err := c.keys.wrap(dataKey)
+		if err != nil {
+			return nil, err
+		}
+
+		p.KeyID = keyID
+		p.DataKey = encodeBase64(wrapped)
+	}
+
+	var err error
+	if p.Header, p.HeaderFormat, err = c.encode(header, c.Headers, dataKey, id+":header"); err != nil {
+		return nil, err
+	}
+	if p.Body, p.BodyFormat, err = c.encode(body, true, dataKey, id+":body"); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Decode restores the header and body of the request with the id
+func (c *Codec) Decode(id string, p *Payload) ([]byte, []byte, error) {
+	var dataKey []byte
+	if p.KeyID != "" {
+		if c.keys == nil {
+			return nil, nil, fmt.Errorf("payload is encrypted with key %q, but no keys configured", p.KeyID)
+		}
+
+		wrapped, err := decodeBase64(p.DataKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if dataKey, err = c.keys.unwrap(p.KeyID, wrapped); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	header, err := decode(p.Header, p.HeaderFormat, dataKey, id+":header")
+	if err != nil {
+		return nil, nil, fmt.Errorf("header: %s", err)
+	}
+
+	body, err := decode(p.Body, p.BodyFormat, dataKey, id+":body")
+	if err != nil {
+		return nil, nil, fmt.Errorf("body: %s", err)
+	}
+
+	return header, body, nil
+}
+
+func (c *Codec) encode(data []byte, compress bool, dataKey []byte, additionalData string) ([]byte, int, error) {
+	payload, compressed, err := c.compress(data, compress)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if dataKey == nil {
+		if !compressed {
+			return data, FormatPlain, nil
+		}
+
+		return payload, FormatV1, nil
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sealed, err := seal(aead, payload, []byte(additionalData))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return sealed, FormatV2, nil
+}
+
+// Returns the compression algorithm byte followed by the data
+// and whether it was compressed
+func (c *Codec) compress(data []byte, compress bool) ([]byte, bool, error) {
+	plain := append([]byte{compressionNone}, data...)
+
+	if !compress || c.minSize <= 0 || len(data) < c.minSize {
+		return plain, false, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressionGzip)
+
+	zw, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err = zw.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	// Incompressible data is kept as is
+	if buf.Len() >= len(plain) {
+		return plain, false, nil
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+func decode(stored []byte, format int, dataKey []byte, additionalData string) ([]byte, error) {
+	switch format {
+	case FormatPlain:
+		return stored, nil
+	case FormatV1:
+		return decompress(stored)
+	case FormatV2:
+		if dataKey == nil {
+			return nil, fmt.Errorf("encrypted payload without key")
+		}
+
+		aead, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := open(aead, stored, []byte(additionalData))
+		if err != nil {
+			return nil, err
+		}
+
+		return decompress(data)
+	}
+
+	return nil, fmt.Errorf("unknown payload format %d", format)
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+
+	switch data[0] {
+	case compressionNone:
+		return data[1:], nil
+	case compressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		return ioutil.ReadAll(zr)
+	}
+
+	return nil, fmt.Errorf("unknown compression %d", data[0])
+}
+
+func encodeBase64(data []byte) []byte {
+	result := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(result, data)
+
+	return result
+}
+
+func decodeBase64(data []byte) ([]byte, error) {
+	result := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(result, data)
+
+	return result[:n], err
+}
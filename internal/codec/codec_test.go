@@ -0,0 +1,166 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+var (
+	oldKey = "old:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey = "new:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func TestEncodeDecode(t *testing.T) {
+	c, err := New(cfg.Compression{MinSize: 64}, cfg.Encryption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header := []byte(`{"Content-Type":["application/xml"]}`)
+
+	cases := []struct {
+		body   []byte
+		format int
+	}{
+		{[]byte(`{"small":true}`), FormatPlain},
+		{bytes.Repeat([]byte(`<item>value</item>`), 100), FormatV1},
+		{nil, FormatPlain},
+	}
+
+	for _, tc := range cases {
+		p, err := c.Encode("id", header, tc.body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if p.BodyFormat != tc.format {
+			t.Errorf("expected format %d, got %d", tc.format, p.BodyFormat)
+		}
+		if p.BodyFormat == FormatV1 && len(p.Body) >= len(tc.body) {
+			t.Errorf("expected payload to be compressed: %d >= %d", len(p.Body), len(tc.body))
+		}
+		if p.HeaderFormat != FormatPlain || p.KeyID != "" {
+			t.Errorf("expected header to be stored as is: %d %q", p.HeaderFormat, p.KeyID)
+		}
+
+		decodedHeader, body, err := c.Decode("id", p)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(body, tc.body) || !bytes.Equal(decodedHeader, header) {
+			t.Errorf("expected the same payload after decoding: %q %q", decodedHeader, body)
+		}
+	}
+}
+
+func TestEncodeIncompressible(t *testing.T) {
+	c, err := New(cfg.Compression{MinSize: 1}, cfg.Encryption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	body := []byte("abc")
+	p, err := c.Encode("id", nil, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p.BodyFormat != FormatPlain || !bytes.Equal(p.Body, body) {
+		t.Errorf("expected incompressible payload to be stored as is: %d %q", p.BodyFormat, p.Body)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	t.Setenv("TEST_ASYNCPROXY_KEYS", oldKey)
+
+	old, err := New(cfg.Compression{MinSize: 16}, cfg.Encryption{KeyEnv: "TEST_ASYNCPROXY_KEYS"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header := []byte(`{"Authorization":["Bearer secret"]}`)
+	body := bytes.Repeat([]byte("secret"), 10)
+
+	p, err := old.Encode("id", header, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p.KeyID != "old" || p.HeaderFormat != FormatV2 || p.BodyFormat != FormatV2 {
+		t.Fatalf("expected payload to be encrypted: %q %d %d", p.KeyID, p.HeaderFormat, p.BodyFormat)
+	}
+	if strings.Contains(string(p.Header), "secret") || bytes.Contains(p.DataKey, []byte("secret")) {
+		t.Errorf("expected header to be encrypted: %s", p.Header)
+	}
+
+	// The old key is kept for decryption after the rotation
+	t.Setenv("TEST_ASYNCPROXY_KEYS", newKey+","+oldKey)
+
+	rotated, err := New(cfg.Compression{}, cfg.Encryption{KeyEnv: "TEST_ASYNCPROXY_KEYS"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if keyID, _ := rotated.Encrypted(); keyID != "new" {
+		t.Errorf("expected the first key to be active: %s", keyID)
+	}
+
+	decodedHeader, decodedBody, err := rotated.Decode("id", p)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(decodedHeader, header) || !bytes.Equal(decodedBody, body) {
+		t.Errorf("expected the same payload after decoding: %q %q", decodedHeader, decodedBody)
+	}
+
+	if _, _, err = rotated.Decode("other", p); err == nil {
+		t.Errorf("expected payload of another row to be rejected")
+	}
+
+	plain, err := New(cfg.Compression{}, cfg.Encryption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err = plain.Decode("id", p); err == nil {
+		t.Errorf("expected encrypted payload to be rejected without keys")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keyring, err := parseKeys("# rotated on 2026-10-01\n" + newKey + "\n\n" + oldKey + "\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if keyring.Active() != "new" || len(keyring.keys) != 2 {
+		t.Errorf("unexpected keyring: %s, %d keys", keyring.Active(), len(keyring.keys))
+	}
+
+	for _, text := range []string{"", "nokey", "short:" + base64.StdEncoding.EncodeToString([]byte("short")), oldKey + "," + oldKey} {
+		if _, err = parseKeys(text); err == nil {
+			t.Errorf("%q: expected keys to be rejected", text)
+		}
+	}
+
+	if _, err = New(cfg.Compression{}, cfg.Encryption{KeyEnv: "TEST_ASYNCPROXY_MISSING"}); err == nil {
+		t.Errorf("expected missing environment variable to be rejected")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	c, err := New(cfg.Compression{}, cfg.Encryption{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, _, err = c.Decode("id", &Payload{Body: []byte("abc"), BodyFormat: 42}); err == nil {
+		t.Errorf("expected unknown format to be rejected")
+	}
+
+	if _, _, err = c.Decode("id", &Payload{Body: []byte{42, 1, 2}, BodyFormat: FormatV1}); err == nil {
+		t.Errorf("expected broken payload to be rejected")
+	}
+
+	if _, err = New(cfg.Compression{Level: 42}, cfg.Encryption{}); err == nil {
+		t.Errorf("expected invalid level to be rejected")
+	}
+}
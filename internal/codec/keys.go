@@ -0,0 +1,164 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Keyring holds the master keys wrapping the per-row data keys.
+// New rows are encrypted with the active key, the others are kept
+// to decrypt the rows encrypted before the rotation.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// Loads the keys from the file and the environment variable,
+// nil if none configured
+func loadKeyring(config cfg.Encryption) (*Keyring, error) {
+	var sources []string
+
+	if config.KeyFile != "" {
+		data, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, string(data))
+	}
+
+	if config.KeyEnv != "" {
+		value, ok := os.LookupEnv(config.KeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", config.KeyEnv)
+		}
+		sources = append(sources, value)
+	}
+
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	keyring, err := parseKeys(strings.Join(sources, "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ActiveKey != "" {
+		if _, ok := keyring.keys[config.ActiveKey]; !ok {
+			return nil, fmt.Errorf("unknown active key %q", config.ActiveKey)
+		}
+		keyring.active = config.ActiveKey
+	}
+
+	return keyring, nil
+}
+
+// Keys are separated by new lines or commas: <id>:<base64 key>.
+// Lines starting with # are ignored. The first key is the active one.
+func parseKeys(text string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key entry, expected <id>:<base64 key>")
+		}
+
+		id := parts[0]
+		if _, ok := keyring.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", id, err)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", id, err)
+		}
+
+		keyring.keys[id] = aead
+		if keyring.active == "" {
+			keyring.active = id
+		}
+	}
+
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("no encryption keys found")
+	}
+
+	return keyring, nil
+}
+
+// Active returns the ID of the key encrypting the new rows
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+// Encrypts the data key with the active key
+func (k *Keyring) wrap(dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(k.keys[k.active], dataKey, []byte(k.active))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return k.active, wrapped, nil
+}
+
+func (k *Keyring) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+
+	return open(aead, wrapped, []byte(keyID))
+}
+
+// AES-GCM with 128, 192 or 256-bit key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Returns the random nonce followed by the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted payload is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
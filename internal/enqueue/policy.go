@@ -0,0 +1,300 @@
+// Package enqueue decides when the requests are put into the queue
+// instead of being sent directly
+package enqueue
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	defaultWindow       = 30 * time.Second
+	defaultMinRequests  = 20
+	defaultRecoverRatio = 0.5
+	defaultHold         = 30 * time.Second
+
+	// How often the signals are checked
+	evaluateInterval = time.Second
+
+	// Latest sends kept for the window
+	maxSamples = 4096
+)
+
+var (
+	queueingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "enqueue_policy_queueing",
+		Help: "1 if the requests are put into the queue because the upstream is degraded.",
+	})
+
+	switchesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "enqueue_policy_switches_total",
+		Help: "Number of switches between the direct sending and the queueing.",
+	}, []string{"mode"})
+)
+
+// Policy switches to queueing when the upstream latency, the error rate
+// or the queue depth cross the thresholds, and back when all of them
+// are below the recover ratio of the thresholds for the hold time.
+type Policy struct {
+	window       time.Duration
+	minRequests  int
+	latencyP95   time.Duration
+	errorRate    float64
+	queueDepth   uint64
+	recoverRatio float64
+	hold         time.Duration
+
+	// Returns the number of requests in the queue
+	depth func() uint64
+
+	mu      sync.Mutex
+	samples []sample
+	next    int
+
+	queueing   atomic.Bool
+	switchedAt time.Time
+
+	now  func() time.Time
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Outcome of the sent request
+type sample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+// Signals observed in the window
+type stats struct {
+	requests   int
+	latencyP95 time.Duration
+	errorRate  float64
+	queueDepth uint64
+}
+
+// NewPolicy returns nil if the policy is not enabled
+func NewPolicy(config *cfg.Config, depth func() uint64) *Policy {
+	p, err := newPolicy(config.Server.EnqueuePolicy, depth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"window":      p.window,
+		"latency_p95": p.latencyP95,
+		"error_rate":  p.errorRate,
+		"queue_depth": p.queueDepth,
+	}).Info("Initializing enqueue policy")
+
+	go p.run()
+
+	return p
+}
+
+func newPolicy(config cfg.EnqueuePolicy, depth func() uint64) (*Policy, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	p := &Policy{
+		window:       config.Window,
+		minRequests:  config.MinRequests,
+		latencyP95:   config.LatencyP95,
+		errorRate:    config.ErrorRate,
+		queueDepth:   config.QueueDepth,
+		recoverRatio: config.RecoverRatio,
+		hold:         config.Hold,
+		depth:        depth,
+		samples:      make([]sample, 0, maxSamples),
+		now:          time.Now,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if p.window == 0 {
+		p.window = defaultWindow
+	}
+	if p.minRequests == 0 {
+		p.minRequests = defaultMinRequests
+	}
+	if p.recoverRatio == 0 {
+		p.recoverRatio = defaultRecoverRatio
+	}
+	if p.hold == 0 {
+		p.hold = defaultHold
+	}
+
+	switch {
+	case p.latencyP95 == 0 && p.errorRate == 0 && p.queueDepth == 0:
+		return nil, errors.New("enqueue policy needs latency_p95, error_rate or queue_depth")
+	case p.window < 0 || p.minRequests < 0 || p.latencyP95 < 0 || p.hold < 0:
+		return nil, errors.New("enqueue policy durations and min_requests must be >= 0")
+	case p.errorRate < 0 || p.errorRate > 1:
+		return nil, errors.New("enqueue policy error_rate must be between 0 and 1")
+	case p.recoverRatio <= 0 || p.recoverRatio > 1:
+		return nil, errors.New("enqueue policy recover_ratio must be between 0 and 1")
+	}
+
+	return p, nil
+}
+
+func (p *Policy) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(evaluateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evaluate()
+		}
+	}
+}
+
+func (p *Policy) Shutdown() {
+	close(p.stop)
+	<-p.done
+}
+
+// Enqueue reports whether the requests should be put into the queue
+func (p *Policy) Enqueue() bool {
+	return p.queueing.Load()
+}
+
+// Observe records the outcome of the sent request
+func (p *Policy) Observe(latency time.Duration, err error) {
+	s := sample{at: p.now(), latency: latency, failed: err != nil}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.samples) < maxSamples {
+		p.samples = append(p.samples, s)
+		return
+	}
+
+	p.samples[p.next] = s
+	p.next = (p.next + 1) % maxSamples
+}
+
+// Switches the mode if the signals crossed the thresholds
+func (p *Policy) evaluate() {
+	now := p.now()
+	s := p.stats(now)
+
+	if p.queueing.Load() {
+		if now.Sub(p.switchedAt) >= p.hold && p.recovered(s) {
+			p.switchTo(false, now, s)
+		}
+		return
+	}
+
+	if p.degraded(s) {
+		p.switchTo(true, now, s)
+	}
+}
+
+func (p *Policy) degraded(s stats) bool {
+	if p.queueDepth > 0 && s.queueDepth > p.queueDepth {
+		return true
+	}
+
+	if s.requests < p.minRequests {
+		return false
+	}
+
+	return p.latencyP95 > 0 && s.latencyP95 > p.latencyP95 ||
+		p.errorRate > 0 && s.errorRate > p.errorRate
+}
+
+func (p *Policy) recovered(s stats) bool {
+	if p.queueDepth > 0 && float64(s.queueDepth) > p.recoverRatio*float64(p.queueDepth) {
+		return false
+	}
+
+	// Not enough sends to tell
+	if s.requests < p.minRequests {
+		return true
+	}
+
+	return (p.latencyP95 == 0 || float64(s.latencyP95) <= p.recoverRatio*float64(p.latencyP95)) &&
+		(p.errorRate == 0 || s.errorRate <= p.recoverRatio*p.errorRate)
+}
+
+func (p *Policy) switchTo(queueing bool, now time.Time, s stats) {
+	p.queueing.Store(queueing)
+	p.switchedAt = now
+
+	mode := "direct"
+	if queueing {
+		mode = "queue"
+		queueingGauge.Set(1)
+	} else {
+		queueingGauge.Set(0)
+	}
+	switchesCounter.WithLabelValues(mode).Inc()
+
+	log.WithFields(log.Fields{
+		"mode":        mode,
+		"requests":    s.requests,
+		"latency_p95": s.latencyP95,
+		"error_rate":  s.errorRate,
+		"queue_depth": s.queueDepth,
+	}).Warn("Enqueue policy switched")
+}
+
+// Computes the signals of the sends within the window
+func (p *Policy) stats(now time.Time) stats {
+	var (
+		s         stats
+		latencies []time.Duration
+		failed    int
+	)
+
+	p.mu.Lock()
+	for _, sample := range p.samples {
+		if now.Sub(sample.at) > p.window {
+			continue
+		}
+
+		latencies = append(latencies, sample.latency)
+		if sample.failed {
+			failed++
+		}
+	}
+	p.mu.Unlock()
+
+	if p.queueDepth > 0 {
+		s.queueDepth = p.depth()
+	}
+
+	s.requests = len(latencies)
+	if s.requests == 0 {
+		return s
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	s.latencyP95 = latencies[(len(latencies)*95+99)/100-1]
+	s.errorRate = float64(failed) / float64(s.requests)
+
+	return s
+}
@@ -0,0 +1,119 @@
+package enqueue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestPolicy(t *testing.T) {
+	var depth uint64
+	p, err := newPolicy(cfg.EnqueuePolicy{
+		Enabled:     true,
+		Window:      10 * time.Second,
+		MinRequests: 10,
+		LatencyP95:  time.Second,
+		ErrorRate:   0.2,
+		QueueDepth:  100,
+		Hold:        5 * time.Second,
+	}, func() uint64 { return depth })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	observe := func(n int, latency time.Duration, failed int) {
+		for i := 0; i < n; i++ {
+			var err error
+			if i < failed {
+				err = errors.New("response 502")
+			}
+			p.Observe(latency, err)
+		}
+	}
+
+	// Too few requests to tell
+	observe(5, 2*time.Second, 5)
+	p.evaluate()
+	if p.Enqueue() {
+		t.Fatal("expected direct sending with few requests")
+	}
+
+	now = now.Add(11 * time.Second)
+
+	observe(20, 100*time.Millisecond, 0)
+	p.evaluate()
+	if p.Enqueue() {
+		t.Fatal("expected direct sending with healthy upstream")
+	}
+
+	// 25% of the requests are slow
+	observe(10, 2*time.Second, 0)
+	p.evaluate()
+	if !p.Enqueue() {
+		t.Fatal("expected queueing with high latency")
+	}
+
+	// Samples are out of the window but the hold time isn't over
+	now = now.Add(11 * time.Second)
+	p.switchedAt = now
+	p.evaluate()
+	if !p.Enqueue() {
+		t.Fatal("expected queueing during the hold time")
+	}
+
+	// Error rate is between the recover ratio and the threshold
+	now = now.Add(5 * time.Second)
+	observe(20, 100*time.Millisecond, 3)
+	p.evaluate()
+	if !p.Enqueue() {
+		t.Fatal("expected queueing until the error rate recovers")
+	}
+
+	now = now.Add(11 * time.Second)
+	observe(20, 100*time.Millisecond, 1)
+	p.evaluate()
+	if p.Enqueue() {
+		t.Fatal("expected direct sending after recovery")
+	}
+
+	depth = 101
+	p.evaluate()
+	if !p.Enqueue() {
+		t.Fatal("expected queueing with deep queue")
+	}
+
+	now = now.Add(5 * time.Second)
+	depth = 60
+	p.evaluate()
+	if !p.Enqueue() {
+		t.Fatal("expected queueing until the queue drains below the recover ratio")
+	}
+
+	depth = 50
+	p.evaluate()
+	if p.Enqueue() {
+		t.Fatal("expected direct sending after the queue drained")
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	if p, err := newPolicy(cfg.EnqueuePolicy{}, nil); p != nil || err != nil {
+		t.Errorf("expected no policy when disabled: %v", err)
+	}
+
+	for _, config := range []cfg.EnqueuePolicy{
+		{Enabled: true},
+		{Enabled: true, ErrorRate: 2},
+		{Enabled: true, ErrorRate: 0.1, RecoverRatio: 1.5},
+		{Enabled: true, LatencyP95: -time.Second},
+	} {
+		if _, err := newPolicy(config, nil); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Package filter matches the incoming requests by their content
+// using expressions: https://expr-lang.org/docs/language-definition
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/route"
+	"github.com/evilmartians/asyncproxy/internal/worker"
+)
+
+const (
+	// Reply with the filter response without proxying
+	ActionDrop = "drop"
+
+	// Proxy the request according to another route
+	ActionRoute = "route"
+
+	// Store tags with the request
+	ActionTag = "tag"
+)
+
+// Filter is the expression and the action to take when it matches
+type Filter struct {
+	Name   string
+	Action string
+
+	program *vm.Program
+
+	response *route.Response
+	route    *route.Route
+	tags     []string
+
+	// The expression refers to the body or json
+	usesBody bool
+}
+
+// Result of the filters evaluation
+type Result struct {
+	// Response to reply with if the request should be dropped
+	Drop *route.Response
+
+	// Route to handle the request with, nil to keep the matched one
+	Route *route.Route
+
+	Tags []string
+
+	// Names of the matched filters
+	Matched []string
+}
+
+// Variables available in the expressions
+type env struct {
+	Method   string            `expr:"method"`
+	Path     string            `expr:"path"`
+	Route    string            `expr:"route"`
+	Producer string            `expr:"producer"`
+	Query    map[string]string `expr:"query"`
+	Header   map[string]string `expr:"header"`
+	Body     string            `expr:"body"`
+	JSON     interface{}       `expr:"json"`
+}
+
+// New compiles the filters or fails fatally
+func New(config *cfg.Config, router *route.Router) []*Filter {
+	filters, err := newFilters(config.Filters, router, config.Server.ResponseStatus)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, f := range filters {
+		log.WithFields(log.Fields{
+			"name":   f.Name,
+			"action": f.Action,
+		}).Info("Initializing filter")
+	}
+
+	return filters
+}
+
+func newFilters(configs []cfg.Filter, router *route.Router, responseStatus int) ([]*Filter, error) {
+	filters := make([]*Filter, 0, len(configs))
+
+	for i, fc := range configs {
+		f, err := newFilter(fc, router, responseStatus)
+		if err != nil {
+			return nil, fmt.Errorf("filter #%d: %s", i, err)
+		}
+
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+func newFilter(fc cfg.Filter, router *route.Router, responseStatus int) (*Filter, error) {
+	program, err := expr.Compile(fc.Expr, expr.Env(env{}), expr.AsBool())
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{
+		Name:     fc.Name,
+		Action:   fc.Action,
+		program:  program,
+		usesBody: usesBody(program),
+	}
+
+	if f.Name == "" {
+		f.Name = fc.Expr
+	}
+
+	switch f.Action {
+	case ActionDrop:
+		if f.response, err = route.NewResponse(fc.Response, responseStatus); err != nil {
+			return nil, err
+		}
+	case ActionRoute:
+		var ok bool
+		if f.route, ok = router.Get(fc.Route); !ok {
+			return nil, fmt.Errorf("unknown route %q", fc.Route)
+		}
+		if f.route.Mode == route.ModeSync {
+			return nil, fmt.Errorf("can't route to synchronous route %q", fc.Route)
+		}
+	case ActionTag:
+		if len(fc.Tags) == 0 {
+			return nil, fmt.Errorf("tags are required")
+		}
+		f.tags = fc.Tags
+	default:
+		return nil, fmt.Errorf("unknown action %q", fc.Action)
+	}
+
+	return f, nil
+}
+
+// Evaluate runs the filters in order. Tags are collected from all matched
+// filters, the first matched drop or route filter stops the evaluation.
+// Filters failing to evaluate are skipped.
+func Evaluate(filters []*Filter, rt *route.Route, r *worker.Request) Result {
+	var result Result
+	if len(filters) == 0 {
+		return result
+	}
+
+	vars, err := newEnv(rt, r, UsesBody(filters))
+	if err != nil {
+		log.WithError(err).Warn("filter error")
+		return result
+	}
+
+	for _, f := range filters {
+		matched, err := expr.Run(f.program, vars)
+		if err != nil {
+			log.WithField("filter", f.Name).WithError(err).Warn("filter error")
+			continue
+		}
+
+		if matched != true {
+			continue
+		}
+
+		result.Matched = append(result.Matched, f.Name)
+
+		switch f.Action {
+		case ActionDrop:
+			result.Drop = f.response
+			return result
+		case ActionRoute:
+			result.Route = f.route
+			return result
+		case ActionTag:
+			result.Tags = append(result.Tags, f.tags...)
+		}
+	}
+
+	return result
+}
+
+// UsesBody reports whether any of the filters needs the request body
+func UsesBody(filters []*Filter) bool {
+	for _, f := range filters {
+		if f.usesBody {
+			return true
+		}
+	}
+
+	return false
+}
+
+type bodyVisitor struct {
+	found bool
+}
+
+func (v *bodyVisitor) Visit(node *ast.Node) {
+	if id, ok := (*node).(*ast.IdentifierNode); ok && (id.Value == "body" || id.Value == "json") {
+		v.found = true
+	}
+}
+
+func usesBody(program *vm.Program) bool {
+	node := program.Node()
+	visitor := &bodyVisitor{}
+	ast.Walk(&node, visitor)
+
+	return visitor.found
+}
+
+// The body is converted and parsed only if the filters need it
+func newEnv(rt *route.Route, r *worker.Request, withBody bool) (env, error) {
+	reqURL, err := url.Parse(r.OriginURL)
+	if err != nil {
+		return env{}, err
+	}
+
+	vars := env{
+		Method:   r.Method,
+		Path:     reqURL.Path,
+		Route:    rt.Name,
+		Producer: r.Meta[worker.MetaProducer],
+		Query:    firstValues(reqURL.Query()),
+		Header:   firstValues(r.Header),
+	}
+
+	if withBody {
+		vars.Body = string(r.Body)
+
+		// Not every body is JSON, json is nil then
+		_ = json.Unmarshal(r.Body, &vars.JSON)
+	}
+
+	return vars, nil
+}
+
+func firstValues(values map[string][]string) map[string]string {
+	result := make(map[string]string, len(values))
+	for name, v := range values {
+		if len(v) > 0 {
+			result[name] = v[0]
+		}
+	}
+
+	return result
+}
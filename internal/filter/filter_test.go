@@ -0,0 +1,117 @@
+package filter
+
+import (
+	"net/http"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/route"
+	"github.com/evilmartians/asyncproxy/internal/worker"
+)
+
+func newTestFilters(t *testing.T, configs []cfg.Filter) []*Filter {
+	t.Helper()
+
+	config := &cfg.Config{Routes: []cfg.Route{{Name: "payments", Path: "/payments"}}}
+	config.Server.ResponseStatus = http.StatusOK
+
+	filters, err := newFilters(configs, route.NewRouter(config), http.StatusOK)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return filters
+}
+
+func newRequest(header http.Header, body string) *worker.Request {
+	return &worker.Request{
+		Method:    "POST",
+		OriginURL: "/hooks?source=stripe",
+		Header:    header,
+		Body:      []byte(body),
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	filters := newTestFilters(t, []cfg.Filter{
+		{Name: "important", Expr: `query.source == "stripe"`, Action: ActionTag, Tags: []string{"stripe"}},
+		{Name: "pings", Expr: `header["X-Event"] == "ping"`, Action: ActionDrop, Response: cfg.Response{Status: 204}},
+		{Name: "invoices", Expr: `json?.type in ["invoice.paid"]`, Action: ActionRoute, Route: "payments"},
+	})
+	rt := &route.Route{Name: "default"}
+
+	result := Evaluate(filters, rt, newRequest(http.Header{"X-Event": {"ping"}}, ""))
+	if result.Drop == nil || result.Drop.Status != 204 {
+		t.Errorf("expected ping to be dropped: %+v", result)
+	}
+	if len(result.Tags) != 1 || result.Tags[0] != "stripe" {
+		t.Errorf("expected tags of the matched filters: %v", result.Tags)
+	}
+
+	result = Evaluate(filters, rt, newRequest(http.Header{}, `{"type":"invoice.paid"}`))
+	if result.Route == nil || result.Route.Name != "payments" {
+		t.Errorf("expected invoice to be routed: %+v", result)
+	}
+
+	result = Evaluate(filters, rt, newRequest(http.Header{}, `<xml/>`))
+	if result.Drop != nil || result.Route != nil {
+		t.Errorf("expected non-JSON request not to match: %+v", result)
+	}
+	if len(result.Matched) != 1 || result.Matched[0] != "important" {
+		t.Errorf("expected only the tag filter to match: %v", result.Matched)
+	}
+}
+
+func TestUsesBody(t *testing.T) {
+	filters := newTestFilters(t, []cfg.Filter{
+		{Expr: `header["X-Event"] == "ping"`, Action: ActionTag, Tags: []string{"ping"}},
+	})
+	if UsesBody(filters) {
+		t.Errorf("expected header filter not to use body")
+	}
+
+	filters = newTestFilters(t, []cfg.Filter{
+		{Expr: `method == "POST" && json?.type == "ping"`, Action: ActionTag, Tags: []string{"ping"}},
+	})
+	if !UsesBody(filters) {
+		t.Errorf("expected json filter to use body")
+	}
+}
+
+func TestNewEnvWithoutBody(t *testing.T) {
+	r := newRequest(http.Header{}, `{"type":"ping"}`)
+
+	vars, err := newEnv(&route.Route{Name: "default"}, r, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if vars.Body != "" || vars.JSON != nil {
+		t.Errorf("expected the body not to be parsed: %+v", vars)
+	}
+
+	vars, _ = newEnv(&route.Route{Name: "default"}, r, true)
+	if vars.Body == "" || vars.JSON == nil {
+		t.Errorf("expected the body to be parsed: %+v", vars)
+	}
+}
+
+func TestNewFilterErrors(t *testing.T) {
+	config := &cfg.Config{Routes: []cfg.Route{{Name: "health", Path: "/health", Mode: route.ModeSync}}}
+	config.Server.ResponseStatus = http.StatusOK
+	router := route.NewRouter(config)
+
+	invalid := []cfg.Filter{
+		{Expr: `method ==`, Action: ActionTag, Tags: []string{"a"}},
+		{Expr: `method`, Action: ActionTag, Tags: []string{"a"}},
+		{Expr: `true`, Action: "prioritize"},
+		{Expr: `true`, Action: ActionRoute, Route: "unknown"},
+		{Expr: `true`, Action: ActionRoute, Route: "health"},
+		{Expr: `true`, Action: ActionTag},
+	}
+
+	for _, fc := range invalid {
+		if _, err := newFilter(fc, router, http.StatusOK); err == nil {
+			t.Errorf("expected filter to be rejected: %+v", fc)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Package oauth2 obtains OAuth2 client credentials tokens for the upstreams
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	defaultExpiryDelta = 30 * time.Second
+	tokenTimeout       = 30 * time.Second
+)
+
+// TokenSource fetches the token and caches it until it is about to expire
+type TokenSource struct {
+	config cfg.OAuth2
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+
+	// Fetch in progress shared by the callers, nil if there is none
+	call *fetchCall
+
+	now func() time.Time
+}
+
+// Result of the token fetch, available once done is closed
+type fetchCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// NewTokenSource returns nil if OAuth2 is not configured
+func NewTokenSource(config cfg.OAuth2) (*TokenSource, error) {
+	if config.TokenURL == "" {
+		return nil, nil
+	}
+
+	if config.ClientID == "" || config.ClientSecret == "" {
+		return nil, fmt.Errorf("oauth2 requires client_id and client_secret")
+	}
+
+	if config.ExpiryDelta == 0 {
+		config.ExpiryDelta = defaultExpiryDelta
+	}
+
+	return &TokenSource{
+		config: config,
+		client: &http.Client{Timeout: tokenTimeout},
+		now:    time.Now,
+	}, nil
+}
+
+// Token returns the cached token or fetches a new one. The lock isn't
+// held during the fetch, concurrent callers wait for the same one.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+
+	if s.token != "" && (s.expiry.IsZero() || s.now().Before(s.expiry)) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+
+	call := s.call
+	if call == nil {
+		call = &fetchCall{done: make(chan struct{})}
+		s.call = call
+
+		go s.fetchToken(call)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Fetches the token for all the callers waiting for it. The fetch
+// isn't bound to any of them, so the others don't fail when the first
+// one is cancelled. The client timeout limits it.
+func (s *TokenSource) fetchToken(call *fetchCall) {
+	token, expiresIn, err := s.fetch(context.Background())
+
+	s.mu.Lock()
+	if err == nil {
+		s.token = token
+		s.expiry = time.Time{}
+		if expiresIn > 0 {
+			// Refresh the token a bit earlier so it doesn't expire in flight,
+			// but keep the short-lived tokens for half of their lifetime
+			delta := s.config.ExpiryDelta
+			if delta > expiresIn/2 {
+				delta = expiresIn / 2
+			}
+			s.expiry = s.now().Add(expiresIn - delta)
+		}
+	}
+	s.call = nil
+	s.mu.Unlock()
+
+	call.token, call.err = token, err
+	close(call.done)
+}
+
+// Invalidate drops the token if it is still cached,
+// so the next call fetches a new one
+func (s *TokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+func (s *TokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	if s.config.Audience != "" {
+		form.Set("audience", s.config.Audience)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("oauth2 token response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("oauth2 token response %d", resp.StatusCode)
+	}
+
+	var token tokenResponse
+	if err = json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("oauth2 token response: %s", err)
+	}
+
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("oauth2 token response: no access_token")
+	}
+
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// Transport injects the token into the requests. When the upstream
+// responds with 401 the token is refreshed and the request is retried once
+// if its body can be replayed.
+type Transport struct {
+	Base   http.RoundTripper
+	Source *TokenSource
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.Source.Token(r.Context())
+	if err != nil {
+		closeBody(r)
+		return nil, err
+	}
+
+	resp, err := t.Base.RoundTrip(authorize(r, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	t.Source.Invalidate(token)
+
+	if r.Body != nil && r.GetBody == nil {
+		return resp, nil
+	}
+
+	retry := r.Clone(r.Context())
+	if r.GetBody != nil {
+		if retry.Body, err = r.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+
+	if token, err = t.Source.Token(r.Context()); err != nil {
+		closeBody(retry)
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	return t.Base.RoundTrip(authorize(retry, token))
+}
+
+// RoundTripper must not modify the original request
+func authorize(r *http.Request, token string) *http.Request {
+	authorized := r.Clone(r.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token)
+
+	return authorized
+}
+
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
@@ -0,0 +1,206 @@
+package oauth2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func tokenServer(t *testing.T, fetches *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "client_credentials" {
+			t.Errorf("expected client credentials grant: %v", r.Form)
+		}
+		if r.Form.Get("scope") != "read write" {
+			t.Errorf("expected scopes: %s", r.Form.Get("scope"))
+		}
+
+		*fetches++
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, *fetches)
+	}))
+}
+
+func newSource(t *testing.T, tokenURL string) *TokenSource {
+	source, err := NewTokenSource(cfg.OAuth2{
+		TokenURL:     tokenURL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return source
+}
+
+func TestTokenCaching(t *testing.T) {
+	var fetches int
+	server := tokenServer(t, &fetches)
+	defer server.Close()
+
+	source := newSource(t, server.URL)
+	now := time.Now()
+	source.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		token, err := source.Token(context.Background())
+		if err != nil || token != "token-1" {
+			t.Errorf("expected cached token: %s, %v", token, err)
+		}
+	}
+
+	// Refreshed before the expiration
+	now = now.Add(time.Hour - 10*time.Second)
+	if token, _ := source.Token(context.Background()); token != "token-2" {
+		t.Errorf("expected token to be refreshed: %s", token)
+	}
+
+	source.Invalidate("token-1")
+	if token, _ := source.Token(context.Background()); token != "token-2" {
+		t.Errorf("expected stale invalidation to be ignored: %s", token)
+	}
+
+	source.Invalidate("token-2")
+	if token, _ := source.Token(context.Background()); token != "token-3" {
+		t.Errorf("expected invalidated token to be refetched: %s", token)
+	}
+}
+
+func TestTransportRetriesUnauthorized(t *testing.T) {
+	var fetches int
+	server := tokenServer(t, &fetches)
+	defer server.Close()
+
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{
+		Transport: &Transport{Base: http.DefaultTransport, Source: newSource(t, server.URL)},
+	}
+
+	req, _ := http.NewRequest("POST", upstream.URL, strings.NewReader("payload"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected retry with the new token to succeed: %d", resp.StatusCode)
+	}
+	if len(bodies) != 2 || bodies[1] != "payload" {
+		t.Errorf("expected the body to be replayed: %v", bodies)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("expected the original request not to be modified")
+	}
+}
+
+func TestShortLivedToken(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		n := atomic.AddInt32(&fetches, 1)
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":20}`, n)
+	}))
+	defer server.Close()
+
+	source := newSource(t, server.URL)
+	now := time.Now()
+	source.now = func() time.Time { return now }
+
+	// Concurrent callers wait for the same fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := source.Token(context.Background()); err != nil || token != "token-1" {
+				t.Errorf("expected the shared token: %s, %v", token, err)
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("expected one fetch, got %d", fetches)
+	}
+
+	// The expiry delta is limited to half of the lifetime
+	now = now.Add(9 * time.Second)
+	if token, _ := source.Token(context.Background()); token != "token-1" {
+		t.Errorf("expected short-lived token to be cached: %s", token)
+	}
+
+	now = now.Add(time.Second)
+	if token, _ := source.Token(context.Background()); token != "token-2" {
+		t.Errorf("expected short-lived token to be refreshed: %s", token)
+	}
+}
+
+func TestTokenCancelledCaller(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"access_token":"token","expires_in":3600}`)
+	}))
+	defer server.Close()
+
+	source := newSource(t, server.URL)
+
+	// The caller starting the fetch goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := source.Token(ctx)
+		first <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected the cancelled caller to fail, got %v", err)
+	}
+
+	waiter := make(chan string, 1)
+	go func() {
+		token, _ := source.Token(context.Background())
+		waiter <- token
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if token := <-waiter; token != "token" {
+		t.Errorf("expected the other caller to get the token, got %q", token)
+	}
+}
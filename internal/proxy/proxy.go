@@ -2,7 +2,13 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +18,16 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/apikey"
+	"github.com/evilmartians/asyncproxy/internal/enqueue"
+	"github.com/evilmartians/asyncproxy/internal/filter"
+	"github.com/evilmartians/asyncproxy/internal/route"
+	"github.com/evilmartians/asyncproxy/internal/shed"
+	"github.com/evilmartians/asyncproxy/internal/spool"
+	"github.com/evilmartians/asyncproxy/internal/tenant"
+	"github.com/evilmartians/asyncproxy/internal/transform"
+	"github.com/evilmartians/asyncproxy/internal/validate"
+	"github.com/evilmartians/asyncproxy/internal/verify"
 	"github.com/evilmartians/asyncproxy/internal/worker"
 )
 
@@ -22,6 +38,26 @@ var (
 		Help:    "Proxy request response time.",
 		Buckets: []float64{.5, 1, 2.5, 5},
 	}, []string{"path", "status"})
+
+	// Metrics for the content filters
+	filterMatchesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_filter_matches_total",
+		Help: "Number of requests matched by filter.",
+	}, []string{"filter"})
+
+	// Metrics for authenticated producers
+	producerRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_producer_requests_total",
+		Help: "Number of requests by producer.",
+	}, []string{"producer", "result"})
+)
+
+const (
+	// Streamed body copy kept in memory by default
+	defaultStreamBuffer = 1 << 20
+
+	// Marks the requests acknowledged but discarded
+	droppedHeader = "X-Asyncproxy-Dropped"
 )
 
 type Proxy struct {
@@ -31,6 +67,26 @@ type Proxy struct {
 	// Main sender object to perform the requests
 	client *worker.Client
 
+	// Finds out how to handle the incoming request
+	router *route.Router
+
+	// Authenticates producers by API keys, nil if not configured
+	authenticator *apikey.Authenticator
+
+	// Drop, route or tag the requests by their content
+	filters []*filter.Filter
+
+	// Finds the tenant of the requests, nil if there are no tenants
+	tenants *tenant.Resolver
+
+	// Streaming is off if the filters need the body
+	filtersUseBody bool
+
+	// Memory for the copy of the streamed body before it is spilled
+	// to a file in streamTempDir
+	streamBuffer  int
+	streamTempDir string
+
 	// Track goroutines for the graceful shutdown
 	asyncRoutines sync.WaitGroup
 
@@ -44,8 +100,34 @@ type Proxy struct {
 	// Can be turned off if database latency is too big
 	enqueueEnabled bool
 
-	// Default response status for reply
-	responseStatus int
+	// Switches to enqueueing when the upstream degrades, nil if disabled
+	enqueuePolicy *enqueue.Policy
+
+	// Sheds the requests when the queue is over the marks, nil if disabled
+	shedding *shed.Monitor
+}
+
+// Reply holds the details of the handled request
+// available in the response templates
+type Reply struct {
+	RequestID string
+	Enqueued  bool
+
+	worker *worker.Worker
+
+	// Acknowledgement to send
+	response *route.Response
+}
+
+// QueueSize returns the number of requests in the whole queue, up to
+// a second stale, if the request was enqueued and 0 if it was sent
+// directly. It's not the position of the request.
+func (r *Reply) QueueSize() uint64 {
+	if !r.Enqueued {
+		return 0
+	}
+
+	return r.worker.Total()
 }
 
 // Init everything related to asynchronous proxying
@@ -55,13 +137,48 @@ func NewProxy(cfg *config.Config) *Proxy {
 		"enqueue_rate":    cfg.Server.EnqueueRate,
 	}).Info("Initializing proxy")
 
-	return &Proxy{
-		client:         worker.NewClient(cfg),
-		worker:         worker.NewWorker(cfg),
+	router := route.NewRouter(cfg)
+	filters := filter.New(cfg, router)
+	client := worker.NewClient(cfg, router)
+
+	p := &Proxy{
+		client:         client,
+		router:         router,
+		authenticator:  apikey.NewAuthenticator(cfg),
+		filters:        filters,
+		filtersUseBody: filter.UsesBody(filters),
+		tenants:        tenant.NewResolver(cfg),
+		streamBuffer:   cfg.Server.StreamBuffer,
+		streamTempDir:  cfg.Server.StreamTempDir,
+		worker:         worker.NewWorker(cfg, client),
 		enqueueEnabled: cfg.Server.EnqueueEnabled,
 		rateLimiter:    rate.NewLimiter(rate.Limit(cfg.Server.EnqueueRate), cfg.Server.EnqueueRate),
-		responseStatus: cfg.Server.ResponseStatus,
 	}
+
+	if p.streamBuffer == 0 {
+		p.streamBuffer = defaultStreamBuffer
+	}
+
+	if p.enqueueEnabled {
+		p.enqueuePolicy = enqueue.NewPolicy(cfg, p.worker.Total)
+	}
+
+	p.shedding = shed.NewMonitor(cfg, p.worker.Total, p.worker.OldestAge)
+
+	if p.filtersUseBody {
+		for _, rt := range router.Routes() {
+			if rt.Stream {
+				log.WithField("route", rt.Name).Warn("Filters use the body, streaming is disabled")
+			}
+		}
+	}
+
+	return p
+}
+
+// Queue returns the queue of the workers
+func (p *Proxy) Queue() worker.Queue {
+	return p.worker.Queue()
 }
 
 // Start workers proxying the requests
@@ -96,6 +213,14 @@ func (p *Proxy) Stop(ctx context.Context) error {
 		return err
 	}
 
+	if p.enqueuePolicy != nil {
+		p.enqueuePolicy.Shutdown()
+	}
+
+	if p.shedding != nil {
+		p.shedding.Shutdown()
+	}
+
 	p.stopWorker()
 	if err = p.worker.Shutdown(ctx); err != nil {
 		return err
@@ -111,64 +236,333 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"ip":     r.RemoteAddr,
 	}).Info("received")
 
-	err := p.HandleRequest(r)
+	producer, err := p.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	rt := p.router.Match(r.URL.Path)
+
+	// Only the authenticated requests are validated
+	if rt.Validator != nil {
+		if err := rt.Validator.Check(w, r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if rt.Mode == route.ModeSync {
+		p.client.Forward(w, r, producer)
+		return
+	}
+
+	reply, err := p.HandleRequest(rt, r, producer)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.WithError(err).Warn("proxying error")
+		writeError(w, err)
 		return
 	}
 
-	w.WriteHeader(p.responseStatus)
+	if err = reply.response.Write(w, reply); err != nil {
+		log.WithError(err).Warn("response error")
+	}
+}
+
+// Returns the producer of the request, empty if there are no API keys
+func (p *Proxy) authenticate(r *http.Request) (string, error) {
+	if p.authenticator == nil {
+		return "", nil
+	}
+
+	producer, err := p.authenticator.Authenticate(r)
+	trackProducerRequest(producer, err)
+
+	return producer, err
 }
 
 // Handle http request: convert it into the proxy request
 // Store it into the queue or just send it
-func (p *Proxy) HandleRequest(r *http.Request) error {
-	request, err := worker.NewRequest(r)
+func (p *Proxy) HandleRequest(rt *route.Route, r *http.Request, producer string) (*Reply, error) {
+	// The streamed body is read only if the request gets into the queue
+	streamed := rt.Stream && !p.filtersUseBody
+
+	request := worker.NewStreamedRequest(r)
+
+	if producer != "" {
+		request.Meta[worker.MetaProducer] = producer
+	}
+
+	// Turn the request away before reading the body
+	err := p.shedding.Check(rt.Name, rt.Shedding)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if !streamed {
+		if request.Body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = checkBody(rt, request); err != nil {
+		return nil, err
+	}
+
+	reply := &Reply{
+		RequestID: request.ID,
+		worker:    p.worker,
+		response:  rt.Response,
 	}
 
-	return p.proxyRequest(r.Context(), request)
+	filtered := filter.Evaluate(p.filters, rt, request)
+	trackFilterMatches(filtered.Matched)
+
+	if filtered.Drop != nil {
+		reply.response = filtered.Drop
+		return reply, nil
+	}
+
+	if filtered.Route != nil {
+		rt = filtered.Route
+		reply.response = rt.Response
+		request.Meta[worker.MetaRoute] = rt.Name
+
+		// The checks of the target route apply as well. The response
+		// writer is used only to close the connection after the body limit.
+		if err = p.shedding.Check(rt.Name, rt.Shedding); err != nil {
+			return nil, err
+		}
+
+		if rt.Validator != nil {
+			if err = rt.Validator.Check(nil, r); err != nil {
+				return nil, err
+			}
+		}
+
+		if streamed && !rt.Stream {
+			if request.Body, err = ioutil.ReadAll(r.Body); err != nil {
+				return nil, err
+			}
+			streamed = false
+		}
+
+		if err = checkBody(rt, request); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(filtered.Tags) > 0 {
+		request.Meta[worker.MetaTags] = strings.Join(filtered.Tags, ",")
+	}
+
+	if p.tenants != nil {
+		request.Meta[worker.MetaTenant] = p.tenants.Resolve(r, rt.Name)
+	}
+
+	if rt.Transform != nil && rt.Transform.Stage == transform.StageEnqueue {
+		if request.Body, err = rt.Transform.Apply(request.Header, request.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	var in *http.Request
+	if streamed {
+		in = r
+	}
+
+	if reply.Enqueued, err = p.proxyRequest(r.Context(), request, in); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// Rejects unsigned and invalid requests before they get into the queue
+func checkBody(rt *route.Route, r *worker.Request) error {
+	if rt.Verifier != nil {
+		if err := rt.Verifier.Verify(r.Header, r.Body); err != nil {
+			return err
+		}
+	}
+
+	if rt.Validator != nil {
+		return rt.Validator.Validate(r.Body)
+	}
+
+	return nil
 }
 
 // Put the proxy request into the queue or send it if queue is disabled
-func (p *Proxy) proxyRequest(ctx context.Context, r *worker.Request) error {
+// Reports whether the request was enqueued. The body of the streamed
+// request is read from the incoming one, nil if it's already read.
+func (p *Proxy) proxyRequest(ctx context.Context, r *worker.Request, streamed *http.Request) (bool, error) {
 	p.asyncRoutines.Add(1)
 	defer p.asyncRoutines.Done()
 
-	if !p.enqueueEnabled || p.rateLimiter.Allow() {
-		return p.SendRequest(ctx, r)
+	if !p.enqueueEnabled || !p.degraded() && p.rateLimiter.Allow() {
+		// Retries of the queued requests are budgeted by all the fresh ones
+		p.worker.Fresh(r)
+
+		if streamed != nil {
+			return p.streamRequest(ctx, r, streamed)
+		}
+
+		return false, p.SendRequest(ctx, r)
 	}
 
 	var err error
+	if streamed != nil {
+		if r.Body, err = ioutil.ReadAll(streamed.Body); err != nil {
+			return false, err
+		}
+	}
+
 	if err = p.worker.Enqueue(r); err == nil {
-		return nil
+		return true, nil
 	}
 
 	log.WithError(err).Warn("enqueueing error, proxying withoud enqueueing")
 
-	return p.SendRequest(ctx, r)
+	p.worker.Fresh(r)
+
+	return false, p.SendRequest(ctx, r)
+}
+
+// Sends the request piping the incoming body to the upstream. A copy
+// of the body is kept, so the request is enqueued if the upstream fails.
+func (p *Proxy) streamRequest(ctx context.Context, r *worker.Request, in *http.Request) (bool, error) {
+	s := spool.New(p.streamBuffer, p.streamTempDir)
+	defer s.Close()
+
+	tee := s.Tee(in.Body)
+
+	err := p.send(r, func() error {
+		return p.client.Stream(ctx, r, tee, in.ContentLength)
+	})
+
+	// The transport may read the body until it closes it
+	<-tee.Done()
+
+	if err == nil || !p.enqueueEnabled {
+		return false, err
+	}
+
+	// Read the rest of the body the upstream didn't get
+	if _, err = io.Copy(s, in.Body); err != nil {
+		return false, err
+	}
+
+	if r.Body, err = s.Bytes(); err != nil {
+		return false, err
+	}
+
+	// The failed send was the first attempt
+	if err = p.worker.Retry(r); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Reports whether the enqueue policy switched to queueing
+func (p *Proxy) degraded() bool {
+	return p.enqueuePolicy != nil && p.enqueuePolicy.Enqueue()
 }
 
 func (p *Proxy) SendRequest(ctx context.Context, r *worker.Request) error {
+	return p.send(r, func() error {
+		return p.client.Do(ctx, r)
+	})
+}
+
+func (p *Proxy) send(r *worker.Request, do func() error) error {
 	var err error
 	res := "OK"
 
 	start := time.Now()
 
-	if err = p.client.Do(ctx, r); err != nil {
+	if err = do(); err != nil {
 		log.WithError(err).Error("proxy error")
 		res = err.Error()
 	}
 
 	trackProxyRequestDuration(start, r, res)
 
+	if p.enqueuePolicy != nil {
+		p.enqueuePolicy.Observe(time.Since(start), err)
+	}
+
 	return err
 }
 
+func writeError(w http.ResponseWriter, err error) {
+	var methodErr *validate.MethodError
+	if errors.As(err, &methodErr) {
+		w.Header().Set("Allow", strings.Join(methodErr.Allowed, ", "))
+	}
+
+	var shedErr *shed.Error
+	if errors.As(err, &shedErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(shedErr.RetryAfter.Seconds()))))
+	}
+
+	// Accepted but not proxied, the client must be able to tell
+	if errors.Is(err, shed.ErrDropped) {
+		w.Header().Set(droppedHeader, "shed")
+	}
+
+	w.WriteHeader(statusCode(err))
+	log.WithError(err).Warn("proxying error")
+}
+
+// Response status for the request handling error
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, validate.ErrBodyTooLarge), errors.As(err, new(*http.MaxBytesError)):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, new(*validate.MethodError)):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, validate.ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, new(*validate.SchemaError)):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, verify.ErrUnauthorized), errors.Is(err, apikey.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, apikey.ErrRateLimited), errors.Is(err, apikey.ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.As(err, new(*transform.Error)):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, new(*shed.Error)):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, shed.ErrDropped):
+		return http.StatusAccepted
+	default:
+		return http.StatusBadRequest
+	}
+}
+
 func trackProxyRequestDuration(start time.Time, r *worker.Request, res string) {
 	proxyRequestsDuration.
 		WithLabelValues(r.OriginURL, res).
 		Observe(time.Since(start).Seconds())
 }
+
+func trackFilterMatches(names []string) {
+	for _, name := range names {
+		filterMatchesCounter.WithLabelValues(name).Inc()
+	}
+}
+
+func trackProducerRequest(producer string, err error) {
+	// Unknown keys are not tracked to keep the labels bounded
+	if producer == "" {
+		return
+	}
+
+	result := "OK"
+	if err != nil {
+		result = err.Error()
+	}
+
+	producerRequestsCounter.WithLabelValues(producer, result).Inc()
+}
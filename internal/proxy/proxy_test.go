@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/apikey"
+	"github.com/evilmartians/asyncproxy/internal/filter"
+	"github.com/evilmartians/asyncproxy/internal/route"
+	"github.com/evilmartians/asyncproxy/internal/shed"
+	"github.com/evilmartians/asyncproxy/internal/validate"
+	"github.com/evilmartians/asyncproxy/internal/worker"
+)
+
+func TestServeSyncAuthenticated(t *testing.T) {
+	var forwarded int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		if r.Header.Get("Authorization") != "" {
+			t.Error("expected the API key not to be forwarded")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{}
+	cfg.Server.ResponseStatus = http.StatusAccepted
+	cfg.Proxy.RemoteUrl = server.URL
+	cfg.Proxy.NumClients = 1
+	cfg.Auth.Keys = []config.APIKey{{Producer: "billing", Key: "secret"}}
+	cfg.Routes = []config.Route{{Name: "health", Path: "/health", Mode: route.ModeSync}}
+
+	router := route.NewRouter(cfg)
+	p := &Proxy{
+		router:        router,
+		client:        worker.NewClient(cfg, router),
+		authenticator: apikey.NewAuthenticator(cfg),
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without key, got %d", rec.Code)
+	}
+	if forwarded != 0 {
+		t.Error("expected the unauthenticated request not to be forwarded")
+	}
+
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/health", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	p.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("expected upstream status with key, got %d", rec.Code)
+	}
+	if forwarded != 1 {
+		t.Error("expected the authenticated request to be forwarded")
+	}
+}
+
+func TestServeAuthenticatedBeforeValidation(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ResponseStatus = http.StatusAccepted
+	cfg.Proxy.RemoteUrl = "http://localhost"
+	cfg.Auth.Keys = []config.APIKey{{Producer: "billing", Key: "secret"}}
+	cfg.Routes = []config.Route{{
+		Name:     "events",
+		Path:     "/events",
+		Validate: config.Validate{Methods: []string{"POST"}},
+	}}
+
+	p := &Proxy{
+		router:        route.NewRouter(cfg),
+		authenticator: apikey.NewAuthenticator(cfg),
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/events", nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 before validation, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	p.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for the authenticated request, got %d", rec.Code)
+	}
+}
+
+func TestHandleReroutedRequestChecks(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ResponseStatus = http.StatusAccepted
+	cfg.Routes = []config.Route{
+		{Name: "hooks", Path: "/hooks"},
+		{
+			Name:     "invoices",
+			Path:     "/invoices",
+			Validate: config.Validate{Methods: []string{"POST"}, MaxBodySize: 20},
+		},
+	}
+	cfg.Filters = []config.Filter{{Expr: `json.type == "invoice"`, Action: filter.ActionRoute, Route: "invoices"}}
+
+	router := route.NewRouter(cfg)
+	p := &Proxy{router: router, filters: filter.New(cfg, router), filtersUseBody: true}
+
+	r := httptest.NewRequest("PUT", "/hooks", strings.NewReader(`{"type":"invoice"}`))
+	_, err := p.HandleRequest(router.Match(r.URL.Path), r, "")
+	if !errors.As(err, new(*validate.MethodError)) {
+		t.Errorf("expected the method of the target route to be checked, got %v", err)
+	}
+
+	r = httptest.NewRequest("POST", "/hooks", strings.NewReader(`{"type":"invoice","amount":100}`))
+	_, err = p.HandleRequest(router.Match(r.URL.Path), r, "")
+	if !errors.Is(err, validate.ErrBodyTooLarge) {
+		t.Errorf("expected the body size of the target route to be checked, got %v", err)
+	}
+}
+
+// Fails the test if the body is read
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("expected the body of the shed request not to be read")
+	return 0, io.EOF
+}
+
+func TestHandleShedRequest(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ResponseStatus = http.StatusAccepted
+	cfg.Server.Shedding = config.Shedding{QueueDepth: 10, RetryAfter: time.Minute}
+
+	router := route.NewRouter(cfg)
+	monitor := shed.NewMonitor(cfg, func() uint64 { return 11 }, func() (time.Duration, error) { return 0, nil })
+	defer monitor.Shutdown()
+
+	p := &Proxy{router: router, shedding: monitor}
+
+	r := httptest.NewRequest("POST", "/hooks", unreadBody{t})
+	_, err := p.HandleRequest(router.Match(r.URL.Path), r, "")
+
+	var shedErr *shed.Error
+	if !errors.As(err, &shedErr) || shedErr.RetryAfter != time.Minute {
+		t.Fatalf("expected the request to be shed, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	writeError(rec, err)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected 503 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestHandleDroppedRequest(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ResponseStatus = http.StatusOK
+	cfg.Server.Shedding = config.Shedding{QueueDepth: 10, Action: shed.ActionDrop}
+
+	router := route.NewRouter(cfg)
+	monitor := shed.NewMonitor(cfg, func() uint64 { return 11 }, func() (time.Duration, error) { return 0, nil })
+	defer monitor.Shutdown()
+
+	p := &Proxy{router: router, shedding: monitor}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("POST", "/hooks", unreadBody{t}))
+
+	if rec.Code != http.StatusAccepted || rec.Header().Get(droppedHeader) != "shed" {
+		t.Errorf("expected 202 with the dropped marker, got %d %q", rec.Code, rec.Header().Get(droppedHeader))
+	}
+}
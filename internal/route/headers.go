@@ -0,0 +1,105 @@
+package route
+
+import (
+	"net/http"
+	"sort"
+	"text/template"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// HeaderRules modify the headers of the outgoing requests.
+// Rules are applied in order: remove, rename, set, append.
+// Values of set and append are templates.
+type HeaderRules struct {
+	remove []string
+	rename map[string]string
+	set    map[string]*template.Template
+	append map[string]*template.Template
+}
+
+func newHeaderRules(hc cfg.Headers) (*HeaderRules, error) {
+	if len(hc.Remove)+len(hc.Rename)+len(hc.Set)+len(hc.Append) == 0 {
+		return nil, nil
+	}
+
+	rules := &HeaderRules{
+		rename: make(map[string]string, len(hc.Rename)),
+	}
+
+	for _, name := range hc.Remove {
+		rules.remove = append(rules.remove, http.CanonicalHeaderKey(name))
+	}
+
+	for from, to := range hc.Rename {
+		rules.rename[http.CanonicalHeaderKey(from)] = http.CanonicalHeaderKey(to)
+	}
+
+	var err error
+	if rules.set, err = parseHeaderTemplates(hc.Set); err != nil {
+		return nil, err
+	}
+	if rules.append, err = parseHeaderTemplates(hc.Append); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseHeaderTemplates(values map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(values))
+	for name, value := range values {
+		tmpl, err := parseTemplate(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		templates[http.CanonicalHeaderKey(name)] = tmpl
+	}
+
+	return templates, nil
+}
+
+// Apply modifies the headers rendering the templates with the data
+func (rules *HeaderRules) Apply(header http.Header, data interface{}) error {
+	for _, name := range rules.remove {
+		header.Del(name)
+	}
+
+	// Sorted to make the result predictable if renames overlap
+	from := make([]string, 0, len(rules.rename))
+	for name := range rules.rename {
+		from = append(from, name)
+	}
+	sort.Strings(from)
+
+	for _, name := range from {
+		values, ok := header[name]
+		if !ok {
+			continue
+		}
+
+		header.Del(name)
+		header[rules.rename[name]] = values
+	}
+
+	for name, tmpl := range rules.set {
+		value, err := render(tmpl, data)
+		if err != nil {
+			return err
+		}
+
+		header.Set(name, string(value))
+	}
+
+	for name, tmpl := range rules.append {
+		value, err := render(tmpl, data)
+		if err != nil {
+			return err
+		}
+
+		header.Add(name, string(value))
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package route
+
+import (
+	"net/http"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestHeaderRulesApply(t *testing.T) {
+	rules, err := newHeaderRules(cfg.Headers{
+		Remove: []string{"authorization"},
+		Rename: map[string]string{"x-hub-signature": "x-original-signature"},
+		Set:    map[string]string{"x-request-id": "{{ .RequestID }}"},
+		Append: map[string]string{"x-attempt": "{{ .Attempt }}"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("X-Hub-Signature", "sha1=abc")
+	header.Set("X-Request-Id", "spoofed")
+	header.Set("X-Attempt", "0")
+
+	data := struct {
+		RequestID string
+		Attempt   int
+	}{"abc", 3}
+
+	if err = rules.Apply(header, data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if header.Get("Authorization") != "" {
+		t.Errorf("expected header to be removed")
+	}
+	if header.Get("X-Hub-Signature") != "" || header.Get("X-Original-Signature") != "sha1=abc" {
+		t.Errorf("expected header to be renamed: %v", header)
+	}
+	if header.Get("X-Request-Id") != "abc" {
+		t.Errorf("expected header to be set: %s", header.Get("X-Request-Id"))
+	}
+	if values := header.Values("X-Attempt"); len(values) != 2 || values[1] != "3" {
+		t.Errorf("expected header to be appended: %v", values)
+	}
+
+	if rules, _ = newHeaderRules(cfg.Headers{}); rules != nil {
+		t.Errorf("expected no rules without configuration")
+	}
+}
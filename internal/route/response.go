@@ -0,0 +1,110 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Response is the acknowledgement sent for the asynchronous requests.
+// Header values and body are Go templates.
+type Response struct {
+	Status int
+
+	header map[string]*template.Template
+	body   *template.Template
+}
+
+// NewResponse compiles the response templates
+func NewResponse(rc cfg.Response, defaultStatus int) (*Response, error) {
+	res := &Response{
+		Status: rc.Status,
+		header: make(map[string]*template.Template, len(rc.Headers)),
+	}
+
+	if res.Status == 0 {
+		res.Status = defaultStatus
+	}
+	if res.Status < 100 || res.Status > 999 {
+		return nil, fmt.Errorf("invalid response status %d", res.Status)
+	}
+
+	for name, value := range rc.Headers {
+		tmpl, err := parseTemplate(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		res.header[http.CanonicalHeaderKey(name)] = tmpl
+	}
+
+	if rc.Body != "" {
+		tmpl, err := parseTemplate("body", rc.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		res.body = tmpl
+	}
+
+	return res, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %s", name, err)
+	}
+
+	return tmpl, nil
+}
+
+// Write renders the templates with the data and writes the response.
+// Nothing but the status is written if rendering fails.
+func (res *Response) Write(w http.ResponseWriter, data interface{}) error {
+	header := make(map[string]string, len(res.header))
+	for name, tmpl := range res.header {
+		value, err := render(tmpl, data)
+		if err != nil {
+			w.WriteHeader(res.Status)
+			return err
+		}
+
+		header[name] = string(value)
+	}
+
+	var body []byte
+	if res.body != nil {
+		var err error
+		if body, err = render(res.body, data); err != nil {
+			w.WriteHeader(res.Status)
+			return err
+		}
+	}
+
+	for name, value := range header {
+		w.Header().Set(name, value)
+	}
+
+	w.WriteHeader(res.Status)
+
+	if len(body) > 0 {
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func render(tmpl *template.Template, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rendering %s: %s", tmpl.Name(), err)
+	}
+
+	return buf.Bytes(), nil
+}
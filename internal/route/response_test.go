@@ -0,0 +1,66 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+type testReply struct {
+	RequestID string
+}
+
+func (testReply) QueueSize() int {
+	return 42
+}
+
+func TestResponseWrite(t *testing.T) {
+	res, err := NewResponse(cfg.Response{
+		Status:  http.StatusAccepted,
+		Headers: map[string]string{"location": "/requests/{{ .RequestID }}"},
+		Body:    `{"id":"{{ .RequestID }}","queued":{{ .QueueSize }}}`,
+	}, http.StatusOK)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err = res.Write(rec, testReply{RequestID: "abc"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("expected configured status: %d != %d", rec.Code, http.StatusAccepted)
+	}
+	if rec.Header().Get("Location") != "/requests/abc" {
+		t.Errorf("expected rendered header: %s != /requests/abc", rec.Header().Get("Location"))
+	}
+	if rec.Body.String() != `{"id":"abc","queued":42}` {
+		t.Errorf("expected rendered body: %s", rec.Body.String())
+	}
+}
+
+func TestResponseDefaults(t *testing.T) {
+	res, err := NewResponse(cfg.Response{}, http.StatusOK)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err = res.Write(rec, testReply{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected default status: %d != %d", rec.Code, http.StatusOK)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected empty body: %s", rec.Body.String())
+	}
+
+	if _, err = NewResponse(cfg.Response{Body: "{{ .RequestID"}, http.StatusOK); err == nil {
+		t.Errorf("expected broken template to be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package route
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Rewrite changes the path and the query of the outgoing requests.
+// The path is rewritten in order: strip prefix, regex substitutions,
+// add prefix.
+type Rewrite struct {
+	stripPrefix string
+	addPrefix   string
+	regex       []regexRewrite
+	addQuery    []cfg.QueryParam
+	removeQuery []string
+}
+
+type regexRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func newRewrite(rc cfg.Rewrite) (*Rewrite, error) {
+	if rc.StripPrefix == "" && rc.AddPrefix == "" && len(rc.Regex) == 0 &&
+		len(rc.AddQuery) == 0 && len(rc.RemoveQuery) == 0 {
+		return nil, nil
+	}
+
+	rw := &Rewrite{
+		stripPrefix: rc.StripPrefix,
+		addPrefix:   strings.TrimSuffix(rc.AddPrefix, "/"),
+		addQuery:    rc.AddQuery,
+		removeQuery: rc.RemoveQuery,
+	}
+
+	for _, rr := range rc.Regex {
+		re, err := regexp.Compile(rr.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite regex %q: %s", rr.Match, err)
+		}
+
+		rw.regex = append(rw.regex, regexRewrite{match: re, replace: rr.Replace})
+	}
+
+	return rw, nil
+}
+
+// Apply rewrites the URL in place
+func (rw *Rewrite) Apply(u *url.URL) {
+	path := u.Path
+
+	if rw.stripPrefix != "" && strings.HasPrefix(path, rw.stripPrefix) {
+		path = path[len(rw.stripPrefix):]
+	}
+
+	for _, rr := range rw.regex {
+		path = rr.match.ReplaceAllString(path, rr.replace)
+	}
+
+	if rw.addPrefix != "" {
+		path = rw.addPrefix + path
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if path != u.Path {
+		u.Path = path
+		// Let the URL encode the new path
+		u.RawPath = ""
+	}
+
+	if len(rw.addQuery) == 0 && len(rw.removeQuery) == 0 {
+		return
+	}
+
+	query := u.Query()
+	for _, name := range rw.removeQuery {
+		query.Del(name)
+	}
+	for _, param := range rw.addQuery {
+		query.Add(param.Name, param.Value)
+	}
+
+	u.RawQuery = query.Encode()
+}
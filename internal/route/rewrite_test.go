@@ -0,0 +1,57 @@
+package route
+
+import (
+	"net/url"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestRewriteApply(t *testing.T) {
+	cases := []struct {
+		rewrite cfg.Rewrite
+		in, out string
+	}{
+		{
+			cfg.Rewrite{StripPrefix: "/hooks/stripe", AddPrefix: "/internal/payments/"},
+			"/hooks/stripe/invoice/paid?id=1",
+			"/internal/payments/invoice/paid?id=1",
+		},
+		{
+			cfg.Rewrite{StripPrefix: "/hooks"},
+			"/hooks",
+			"/",
+		},
+		{
+			cfg.Rewrite{Regex: []cfg.RegexRewrite{{Match: `^/v(\d+)/users/(\w+)$`, Replace: "/api/$1/accounts/$2"}}},
+			"/v2/users/john",
+			"/api/2/accounts/john",
+		},
+		{
+			cfg.Rewrite{
+				AddQuery:    []cfg.QueryParam{{Name: "source", Value: "asyncproxy"}},
+				RemoveQuery: []string{"token"},
+			},
+			"/events?token=secret&type=ping",
+			"/events?source=asyncproxy&type=ping",
+		},
+	}
+
+	for _, c := range cases {
+		rw, err := newRewrite(c.rewrite)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		u, _ := url.Parse(c.in)
+		rw.Apply(u)
+
+		if u.String() != c.out {
+			t.Errorf("%s: expected %s, got %s", c.in, c.out, u.String())
+		}
+	}
+
+	if _, err := newRewrite(cfg.Rewrite{Regex: []cfg.RegexRewrite{{Match: "("}}}); err == nil {
+		t.Errorf("expected invalid regex to be rejected")
+	}
+}
@@ -0,0 +1,268 @@
+package route
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/shed"
+	"github.com/evilmartians/asyncproxy/internal/transform"
+	"github.com/evilmartians/asyncproxy/internal/validate"
+	"github.com/evilmartians/asyncproxy/internal/verify"
+	"github.com/evilmartians/asyncproxy/signature"
+)
+
+const (
+	// Requests are acknowledged immediately and proxied in the background
+	ModeAsync = "async"
+
+	// Requests are reverse-proxied in real time
+	ModeSync = "sync"
+
+	defaultName = "default"
+)
+
+// Route describes how requests matching the path prefix are handled
+type Route struct {
+	Name string
+	Path string
+	Mode string
+
+	// Name of the upstream to proxy the requests to, empty for the default
+	Upstream string
+
+	// Stream the bodies of the requests sent directly
+	Stream bool
+
+	// Acknowledgement for asynchronous requests
+	Response *Response
+
+	// Checks the incoming request signature, nil if not required
+	Verifier verify.Verifier
+
+	// Signs the outgoing requests, nil if not required
+	Signer *signature.Signer
+
+	// Modify the outgoing request headers, nil if not configured
+	Headers *HeaderRules
+
+	// Modify the outgoing request path and query, nil if not configured
+	Rewrite *Rewrite
+
+	// Modify the request body, nil if not configured
+	Transform *transform.Pipeline
+
+	// Limits for the incoming requests, nil if not configured
+	Validator *validate.Validator
+
+	// Queue marks to shed the requests at, nil if not configured
+	Shedding *shed.Rule
+}
+
+// Router finds the route for the incoming request path
+type Router struct {
+	// Sorted by path length, the longest prefix goes first
+	routes []*Route
+
+	byName map[string]*Route
+
+	fallback *Route
+}
+
+func NewRouter(config *cfg.Config) *Router {
+	router, err := newRouter(config.Routes, config.Server.ResponseStatus, config.Server.MaxBodySize, config.Server.Shedding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, r := range router.routes {
+		log.WithFields(log.Fields{
+			"name": r.Name,
+			"path": r.Path,
+			"mode": r.Mode,
+		}).Info("Initializing route")
+	}
+
+	return router
+}
+
+func newRouter(routes []cfg.Route, responseStatus int, maxBodySize int64, shedding cfg.Shedding) (*Router, error) {
+	fallback, err := newRoute(cfg.Route{Name: defaultName}, responseStatus, maxBodySize, shedding)
+	if err != nil {
+		return nil, err
+	}
+
+	router := &Router{
+		byName:   make(map[string]*Route, len(routes)),
+		fallback: fallback,
+	}
+
+	for i, rc := range routes {
+		r, err := newRoute(rc, responseStatus, maxBodySize, shedding)
+		if err != nil {
+			return nil, fmt.Errorf("route #%d: %s", i, err)
+		}
+
+		if _, ok := router.byName[r.Name]; ok {
+			return nil, fmt.Errorf("route #%d: duplicate name %q", i, r.Name)
+		}
+
+		router.routes = append(router.routes, r)
+		router.byName[r.Name] = r
+	}
+
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		return len(router.routes[i].Path) > len(router.routes[j].Path)
+	})
+
+	return router, nil
+}
+
+func newRoute(rc cfg.Route, responseStatus int, maxBodySize int64, shedding cfg.Shedding) (*Route, error) {
+	r := &Route{
+		Name:     rc.Name,
+		Path:     rc.Path,
+		Mode:     rc.Mode,
+		Upstream: rc.Upstream,
+		Stream:   rc.Stream,
+	}
+
+	if r.Path == "" {
+		r.Path = "/"
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return nil, fmt.Errorf("path must start with /: %s", r.Path)
+	}
+
+	if r.Name == "" {
+		r.Name = r.Path
+	}
+
+	switch r.Mode {
+	case "":
+		r.Mode = ModeAsync
+	case ModeAsync, ModeSync:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", r.Mode)
+	}
+
+	// Sync requests are streamed to the upstream before the body is read,
+	// the body options would be silently ignored
+	if r.Mode == ModeSync {
+		switch {
+		case r.Stream:
+			return nil, fmt.Errorf("sync routes are always streamed")
+		case rc.Verify.Type != "":
+			return nil, fmt.Errorf("sync routes are not compatible with verification")
+		case rc.Validate.Schema != "":
+			return nil, fmt.Errorf("sync routes are not compatible with schema validation")
+		case len(rc.Transform.Steps) > 0:
+			return nil, fmt.Errorf("sync routes are not compatible with transformation")
+		case rc.Sign.Secret != "":
+			return nil, fmt.Errorf("sync routes are not compatible with signing")
+		}
+	}
+
+	// These need the whole body
+	if r.Stream {
+		switch {
+		case rc.Verify.Type != "":
+			return nil, fmt.Errorf("streaming is not compatible with verification")
+		case rc.Validate.Schema != "":
+			return nil, fmt.Errorf("streaming is not compatible with schema validation")
+		case len(rc.Transform.Steps) > 0:
+			return nil, fmt.Errorf("streaming is not compatible with transformation")
+		case rc.Sign.Secret != "":
+			return nil, fmt.Errorf("streaming is not compatible with signing")
+		}
+	}
+
+	response, err := NewResponse(rc.Response, responseStatus)
+	if err != nil {
+		return nil, err
+	}
+	r.Response = response
+
+	verifier, err := verify.New(rc.Verify)
+	if err != nil {
+		return nil, err
+	}
+	r.Verifier = verifier
+
+	headers, err := newHeaderRules(rc.Headers)
+	if err != nil {
+		return nil, err
+	}
+	r.Headers = headers
+
+	rewrite, err := newRewrite(rc.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	r.Rewrite = rewrite
+
+	pipeline, err := transform.New(rc.Transform)
+	if err != nil {
+		return nil, err
+	}
+	r.Transform = pipeline
+
+	validator, err := validate.New(rc.Validate, maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	r.Validator = validator
+
+	rule, err := shed.New(rc.Shedding, shedding)
+	if err != nil {
+		return nil, err
+	}
+	r.Shedding = rule
+
+	if rc.Sign.Secret != "" {
+		r.Signer = &signature.Signer{
+			Secret: []byte(rc.Sign.Secret),
+			Header: rc.Sign.Header,
+		}
+	}
+
+	return r, nil
+}
+
+// Match returns the route with the longest prefix matching the path
+// or the default asynchronous route.
+func (rt *Router) Match(path string) *Route {
+	for _, r := range rt.routes {
+		if hasPathPrefix(path, r.Path) {
+			return r
+		}
+	}
+
+	return rt.fallback
+}
+
+// Get returns the route by its name
+func (rt *Router) Get(name string) (*Route, bool) {
+	r, ok := rt.byName[name]
+	return r, ok
+}
+
+// Routes returns all configured routes
+func (rt *Router) Routes() []*Route {
+	return rt.routes
+}
+
+// Checks that the prefix matches whole path segments:
+// /hooks matches /hooks and /hooks/github but not /hooksmith
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) ||
+		strings.HasSuffix(prefix, "/") ||
+		path[len(prefix)] == '/'
+}
@@ -0,0 +1,75 @@
+package route
+
+import (
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestMatch(t *testing.T) {
+	router, err := newRouter([]cfg.Route{
+		{Path: "/health", Mode: "sync"},
+		{Name: "hooks", Path: "/hooks"},
+		{Name: "stripe", Path: "/hooks/stripe/", Mode: "async"},
+	}, 200, 0, cfg.Shedding{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		path string
+		name string
+		mode string
+	}{
+		{"/health", "/health", ModeSync},
+		{"/health/db", "/health", ModeSync},
+		{"/healthz", "default", ModeAsync},
+		{"/hooks", "hooks", ModeAsync},
+		{"/hooks/github", "hooks", ModeAsync},
+		{"/hooks/stripe/invoice", "stripe", ModeAsync},
+		{"/notifications", "default", ModeAsync},
+	}
+
+	for _, c := range cases {
+		r := router.Match(c.path)
+		if r.Name != c.name {
+			t.Errorf("%s: expected route %s, got %s", c.path, c.name, r.Name)
+		}
+		if r.Mode != c.mode {
+			t.Errorf("%s: expected mode %s, got %s", c.path, c.mode, r.Mode)
+		}
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	if _, err := newRouter([]cfg.Route{{Path: "/a", Mode: "later"}}, 200, 0, cfg.Shedding{}); err == nil {
+		t.Errorf("expected unknown mode to be rejected")
+	}
+
+	if _, err := newRouter([]cfg.Route{{Path: "a"}}, 200, 0, cfg.Shedding{}); err == nil {
+		t.Errorf("expected relative path to be rejected")
+	}
+
+	if _, err := newRouter([]cfg.Route{{Name: "a", Path: "/a"}, {Name: "a", Path: "/b"}}, 200, 0, cfg.Shedding{}); err == nil {
+		t.Errorf("expected duplicate names to be rejected")
+	}
+
+	streamed := cfg.Route{Path: "/a", Stream: true, Sign: cfg.Sign{Secret: "secret"}}
+	if _, err := newRouter([]cfg.Route{streamed}, 200, 0, cfg.Shedding{}); err == nil {
+		t.Errorf("expected streaming of signed requests to be rejected")
+	}
+
+	syncRoutes := map[string]cfg.Route{
+		"streaming":         {Stream: true},
+		"verification":      {Verify: cfg.Verify{Type: "github", Secret: "secret"}},
+		"schema validation": {Validate: cfg.Validate{Schema: `{"type":"object"}`}},
+		"transformation":    {Transform: cfg.Transform{Steps: []cfg.TransformStep{{Type: "xml_to_json"}}}},
+		"signing":           {Sign: cfg.Sign{Secret: "secret"}},
+	}
+	for option, rc := range syncRoutes {
+		rc.Path, rc.Mode = "/a", ModeSync
+		if _, err := newRouter([]cfg.Route{rc}, 200, 0, cfg.Shedding{}); err == nil {
+			t.Errorf("expected %s of sync requests to be rejected", option)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Package shed turns the incoming requests away when the queue grows
+// over the high-water marks
+package shed
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	// Requests are responded with 503 and Retry-After
+	ActionReject = "reject"
+
+	// Requests are acknowledged but not proxied
+	ActionDrop = "drop"
+
+	defaultRetryAfter = 30 * time.Second
+
+	// How often the queue is measured
+	refreshInterval = 5 * time.Second
+)
+
+// ErrDropped is returned for the requests shed by the drop action
+var ErrDropped = errors.New("request dropped by load shedding")
+
+var (
+	shedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shed_requests_total",
+		Help: "Number of requests shed by route, action and the crossed mark.",
+	}, []string{"route", "action", "reason"})
+
+	oldestAgeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "shed_queue_oldest_age_seconds",
+		Help: "Age of the oldest request in the queue seen by the load shedding.",
+	})
+)
+
+// Error is returned for the requests shed by the reject action
+type Error struct {
+	Route      string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("route %s is shed: %s is over the mark", e.Route, e.Reason)
+}
+
+// Rule holds the high-water marks of the route
+type Rule struct {
+	queueDepth uint64
+	oldestAge  time.Duration
+	action     string
+	retryAfter time.Duration
+}
+
+// New returns nil if no marks configured. The route settings
+// default to the server ones.
+func New(config, defaults cfg.Shedding) (*Rule, error) {
+	r := &Rule{
+		queueDepth: config.QueueDepth,
+		oldestAge:  config.OldestAge,
+		action:     config.Action,
+		retryAfter: config.RetryAfter,
+	}
+
+	if r.queueDepth == 0 {
+		r.queueDepth = defaults.QueueDepth
+	}
+	if r.oldestAge == 0 {
+		r.oldestAge = defaults.OldestAge
+	}
+	if r.action == "" {
+		r.action = defaults.Action
+	}
+	if r.retryAfter == 0 {
+		r.retryAfter = defaults.RetryAfter
+	}
+
+	switch r.action {
+	case "":
+		r.action = ActionReject
+	case ActionReject, ActionDrop:
+	default:
+		return nil, fmt.Errorf("unknown shedding action %q", r.action)
+	}
+
+	if r.oldestAge < 0 || r.retryAfter < 0 {
+		return nil, errors.New("shedding durations must be >= 0")
+	}
+
+	if r.queueDepth == 0 && r.oldestAge == 0 {
+		return nil, nil
+	}
+
+	if r.retryAfter == 0 {
+		r.retryAfter = defaultRetryAfter
+	}
+
+	return r, nil
+}
+
+// Monitor keeps the latest queue depth and the oldest request age
+// to check the requests against the marks without querying the queue
+type Monitor struct {
+	depth  func() uint64
+	oldest func() (time.Duration, error)
+
+	queueDepth atomic.Uint64
+	oldestAge  atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMonitor returns nil if neither the server nor the routes
+// have the marks configured
+func NewMonitor(config *cfg.Config, depth func() uint64, oldest func() (time.Duration, error)) *Monitor {
+	if !configured(config) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"queue_depth": config.Server.Shedding.QueueDepth,
+		"oldest_age":  config.Server.Shedding.OldestAge,
+		"action":      config.Server.Shedding.Action,
+	}).Info("Initializing load shedding")
+
+	m := newMonitor(depth, oldest)
+	m.refresh()
+
+	go m.run()
+
+	return m
+}
+
+func newMonitor(depth func() uint64, oldest func() (time.Duration, error)) *Monitor {
+	return &Monitor{
+		depth:  depth,
+		oldest: oldest,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func configured(config *cfg.Config) bool {
+	marked := func(s cfg.Shedding) bool {
+		return s.QueueDepth > 0 || s.OldestAge > 0
+	}
+
+	if marked(config.Server.Shedding) {
+		return true
+	}
+
+	for _, r := range config.Routes {
+		if marked(r.Shedding) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Monitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.refresh()
+		}
+	}
+}
+
+func (m *Monitor) Shutdown() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *Monitor) refresh() {
+	m.queueDepth.Store(m.depth())
+
+	age, err := m.oldest()
+	if err != nil {
+		// Keeps the previous age so the shedding doesn't flap
+		log.WithError(err).Warn("couldn't get the oldest request age")
+		return
+	}
+
+	m.oldestAge.Store(int64(age))
+	oldestAgeGauge.Set(age.Seconds())
+}
+
+// Check returns Error or ErrDropped if the queue is over the marks
+// of the route, nil if the request can be handled
+func (m *Monitor) Check(route string, r *Rule) error {
+	if m == nil || r == nil {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case r.queueDepth > 0 && m.queueDepth.Load() > r.queueDepth:
+		reason = "queue_depth"
+	case r.oldestAge > 0 && time.Duration(m.oldestAge.Load()) > r.oldestAge:
+		reason = "oldest_age"
+	default:
+		return nil
+	}
+
+	shedCounter.WithLabelValues(route, r.action, reason).Inc()
+
+	if r.action == ActionDrop {
+		return ErrDropped
+	}
+
+	return &Error{Route: route, Reason: reason, RetryAfter: r.retryAfter}
+}
@@ -0,0 +1,75 @@
+package shed
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestNew(t *testing.T) {
+	if r, err := New(cfg.Shedding{}, cfg.Shedding{RetryAfter: time.Second}); r != nil || err != nil {
+		t.Errorf("expected no rule without marks: %v", err)
+	}
+
+	r, err := New(cfg.Shedding{QueueDepth: 10}, cfg.Shedding{QueueDepth: 100, OldestAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.queueDepth != 10 || r.oldestAge != time.Hour || r.action != ActionReject || r.retryAfter != defaultRetryAfter {
+		t.Errorf("unexpected rule: %+v", r)
+	}
+
+	for _, config := range []cfg.Shedding{
+		{QueueDepth: 10, Action: "ignore"},
+		{QueueDepth: 10, RetryAfter: -time.Second},
+	} {
+		if _, err := New(config, cfg.Shedding{}); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		depth uint64
+		age   time.Duration
+	)
+	m := newMonitor(func() uint64 { return depth }, func() (time.Duration, error) { return age, nil })
+
+	defaults := cfg.Shedding{QueueDepth: 100, OldestAge: time.Hour, RetryAfter: time.Minute}
+	critical, _ := New(cfg.Shedding{}, defaults)
+	reports, _ := New(cfg.Shedding{QueueDepth: 10, Action: ActionDrop}, defaults)
+
+	depth = 50
+	m.refresh()
+	if err := m.Check("critical", critical); err != nil {
+		t.Errorf("expected request to be handled: %v", err)
+	}
+	if err := m.Check("reports", reports); !errors.Is(err, ErrDropped) {
+		t.Errorf("expected low-priority request to be dropped: %v", err)
+	}
+
+	depth, age = 0, 2*time.Hour
+	m.refresh()
+	var shedErr *Error
+	if err := m.Check("critical", critical); !errors.As(err, &shedErr) {
+		t.Fatalf("expected request to be rejected: %v", err)
+	}
+	if shedErr.Reason != "oldest_age" || shedErr.RetryAfter != time.Minute {
+		t.Errorf("unexpected error: %+v", shedErr)
+	}
+
+	// Previous age is kept if the queue can't be measured
+	m.oldest = func() (time.Duration, error) { return 0, errors.New("connection refused") }
+	m.refresh()
+	if err := m.Check("critical", critical); err == nil {
+		t.Error("expected request to be rejected with the previous age")
+	}
+
+	var disabled *Monitor
+	if err := disabled.Check("critical", critical); err != nil {
+		t.Errorf("expected no shedding without monitor: %v", err)
+	}
+}
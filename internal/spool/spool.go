@@ -0,0 +1,125 @@
+// Package spool keeps a copy of the streamed body in memory
+// spilling it to a temporary file once it gets large
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var errClosed = errors.New("body is closed")
+
+// Spool is the bounded in-memory buffer backed by a temporary file
+type Spool struct {
+	maxMemory int
+	dir       string
+
+	buf  bytes.Buffer
+	file *os.File
+}
+
+// New spills the data to a file in the dir after maxMemory bytes,
+// the default temporary directory is used if dir is empty
+func New(maxMemory int, dir string) *Spool {
+	return &Spool{maxMemory: maxMemory, dir: dir}
+}
+
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) <= s.maxMemory {
+		return s.buf.Write(p)
+	}
+
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "asyncproxy-body-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+
+		if _, err = s.buf.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.file.Write(p)
+}
+
+// Bytes returns all the written data
+func (s *Spool) Bytes() ([]byte, error) {
+	if s.file == nil {
+		return s.buf.Bytes(), nil
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(s.file)
+}
+
+// Close removes the temporary file
+func (s *Spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	s.file.Close()
+
+	return os.Remove(s.file.Name())
+}
+
+// Tee copies everything read from the body to the spool
+func (s *Spool) Tee(body io.Reader) *Tee {
+	return &Tee{body: body, spool: s, done: make(chan struct{})}
+}
+
+// Tee is the request body for the transport. The transport may read
+// it even after the response is received, so the spool is safe to use
+// only after the transport closes the body.
+type Tee struct {
+	mu     sync.Mutex
+	body   io.Reader
+	spool  *Spool
+	closed bool
+
+	done chan struct{}
+}
+
+func (t *Tee) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, errClosed
+	}
+
+	n, err := t.body.Read(p)
+	if n > 0 {
+		if _, writeErr := t.spool.Write(p[:n]); writeErr != nil {
+			return n, writeErr
+		}
+	}
+
+	return n, err
+}
+
+func (t *Tee) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+
+	return nil
+}
+
+// Done is closed once the body is closed
+func (t *Tee) Done() <-chan struct{} {
+	return t.done
+}
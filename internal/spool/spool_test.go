@@ -0,0 +1,85 @@
+package spool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	for _, size := range []int{10, 1000} {
+		dir := t.TempDir()
+		s := New(100, dir)
+		data := bytes.Repeat([]byte{0, 1, 2, 3, 4}, size/5)
+
+		tee := s.Tee(bytes.NewReader(data))
+
+		// Half is read by the transport, the rest after it gives up
+		half := make([]byte, len(data)/2)
+		if _, err := io.ReadFull(tee, half); err != nil {
+			t.Fatal(err)
+		}
+		tee.Close()
+
+		select {
+		case <-tee.Done():
+		default:
+			t.Fatalf("expected tee to be done")
+		}
+
+		if _, err := tee.Read(half); err == nil {
+			t.Errorf("expected closed tee not to be read")
+		}
+
+		rest := data[len(half):]
+		if _, err := io.Copy(s, bytes.NewReader(rest)); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := s.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored, data) {
+			t.Errorf("%d: expected the same data", size)
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		if (size > 100) != (len(files) == 1) {
+			t.Errorf("%d: expected file only for the data larger than the memory limit, got %d", size, len(files))
+		}
+
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		files, _ = ioutil.ReadDir(dir)
+		if len(files) != 0 {
+			t.Errorf("%d: expected temporary file to be removed", size)
+		}
+	}
+}
+
+func TestTeeError(t *testing.T) {
+	s := New(100, t.TempDir())
+	defer s.Close()
+
+	tee := s.Tee(io.MultiReader(strings.NewReader("abc"), errReader{}))
+
+	if _, err := ioutil.ReadAll(tee); err == nil {
+		t.Errorf("expected read error")
+	}
+
+	stored, _ := s.Bytes()
+	if string(stored) != "abc" {
+		t.Errorf("expected read part to be spooled: %q", stored)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
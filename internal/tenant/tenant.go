@@ -0,0 +1,114 @@
+// Package tenant finds the tenant the incoming requests belong to
+package tenant
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Sources of the tenant name
+const (
+	SourceRoute  = "route"
+	SourceHost   = "host"
+	SourceHeader = "header"
+)
+
+const defaultTenant = "default"
+
+// Resolver takes the tenant name from the route, host or header
+type Resolver struct {
+	source string
+	header string
+
+	// Tenant of the requests without one
+	fallback string
+
+	// Tenants accepted from the host and header, the others get
+	// the fallback one to keep the queue tenants and the metrics bounded
+	known map[string]bool
+}
+
+// NewResolver returns nil if the tenants are not configured
+func NewResolver(config *cfg.Config) *Resolver {
+	r, err := newResolver(config.Tenants)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if r != nil {
+		log.WithFields(log.Fields{
+			"source": r.source,
+			"header": r.header,
+		}).Info("Initializing tenants")
+	}
+
+	return r
+}
+
+func newResolver(config cfg.Tenants) (*Resolver, error) {
+	if config.Source == "" {
+		return nil, nil
+	}
+
+	r := &Resolver{
+		source:   config.Source,
+		header:   http.CanonicalHeaderKey(config.Header),
+		fallback: config.Default,
+		known:    make(map[string]bool, len(config.Limits)),
+	}
+
+	for _, limit := range config.Limits {
+		r.known[limit.Tenant] = true
+	}
+
+	if r.fallback == "" {
+		r.fallback = defaultTenant
+	}
+
+	switch r.source {
+	case SourceRoute:
+	case SourceHost, SourceHeader:
+		if r.source == SourceHeader && r.header == "" {
+			return nil, fmt.Errorf("tenant header must be set")
+		}
+		if len(r.known) == 0 {
+			return nil, fmt.Errorf("tenant limits must list the tenants of the %s source", r.source)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tenant source: %q", r.source)
+	}
+
+	return r, nil
+}
+
+// Resolve returns the tenant of the request handled with the route.
+// Route names are configured, the host and header values must be
+// listed in the tenant limits.
+func (r *Resolver) Resolve(req *http.Request, route string) string {
+	var name string
+
+	switch r.source {
+	case SourceRoute:
+		return route
+	case SourceHost:
+		name = req.Host
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+		name = strings.ToLower(name)
+	case SourceHeader:
+		name = req.Header.Get(r.header)
+	}
+
+	if !r.known[name] {
+		return r.fallback
+	}
+
+	return name
+}
@@ -0,0 +1,57 @@
+package tenant
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestResolve(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://Acme.example.com:8080/hooks", nil)
+	r.Header.Set("X-Tenant", "globex")
+
+	// Unknown tenants get the default one
+	known := []cfg.TenantLimit{{Tenant: "acme.example.com"}, {Tenant: "globex"}}
+
+	tests := []struct {
+		config cfg.Tenants
+		route  string
+		want   string
+	}{
+		{cfg.Tenants{Source: SourceRoute}, "orders", "orders"},
+		{cfg.Tenants{Source: SourceHost, Limits: known}, "orders", "acme.example.com"},
+		{cfg.Tenants{Source: SourceHeader, Header: "x-tenant", Limits: known}, "orders", "globex"},
+		{cfg.Tenants{Source: SourceHeader, Header: "X-Customer", Limits: known}, "orders", "default"},
+		{cfg.Tenants{Source: SourceHeader, Header: "X-Customer", Default: "shared", Limits: known}, "orders", "shared"},
+		{cfg.Tenants{Source: SourceHeader, Header: "x-tenant", Limits: known[:1]}, "orders", "default"},
+	}
+
+	for _, tt := range tests {
+		resolver, err := newResolver(tt.config)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if got := resolver.Resolve(r, tt.route); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.config.Source, tt.want, got)
+		}
+	}
+}
+
+func TestNewResolverErrors(t *testing.T) {
+	if r, err := newResolver(cfg.Tenants{}); r != nil || err != nil {
+		t.Errorf("expected no resolver without source: %v", err)
+	}
+
+	for _, config := range []cfg.Tenants{
+		{Source: "path"},
+		{Source: SourceHeader, Limits: []cfg.TenantLimit{{Tenant: "acme"}}},
+		{Source: SourceHeader, Header: "X-Tenant"},
+		{Source: SourceHost},
+	} {
+		if _, err := newResolver(config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Client returns the TLS config for the upstream connections
+// or nil if the defaults should be used.
+func Client(config cfg.ClientTLS) (*tls.Config, error) {
+	if config == (cfg.ClientTLS{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.MinVersion != "" {
+		version, ok := versions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", config.MinVersion)
+		}
+
+		tlsConfig.MinVersion = version
+	}
+
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
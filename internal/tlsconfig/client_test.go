@@ -0,0 +1,50 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestClient(t *testing.T) {
+	config, err := Client(cfg.ClientTLS{})
+	if config != nil || err != nil {
+		t.Errorf("expected default TLS config without settings")
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writeCert(t, certFile, keyFile, "client", time.Now())
+
+	config, err = Client(cfg.ClientTLS{
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "internal.service",
+		MinVersion: "1.3",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if config.RootCAs == nil {
+		t.Errorf("expected custom CA pool")
+	}
+	if len(config.Certificates) != 1 {
+		t.Errorf("expected client certificate")
+	}
+	if config.ServerName != "internal.service" {
+		t.Errorf("expected server name override: %s", config.ServerName)
+	}
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 minimum version: %x", config.MinVersion)
+	}
+
+	if _, err = Client(cfg.ClientTLS{MinVersion: "2.0"}); err == nil {
+		t.Errorf("expected unknown TLS version to be rejected")
+	}
+}
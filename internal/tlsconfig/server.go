@@ -0,0 +1,178 @@
+// Package tlsconfig builds TLS configs from the settings
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// How often the files are checked for changes
+const reloadInterval = 10 * time.Second
+
+// Server returns the listener TLS config or nil if TLS is not configured.
+// Certificate and client CA files are reloaded when they change on disk.
+func Server(config cfg.TLS) (*tls.Config, error) {
+	if config.CertFile == "" && config.KeyFile == "" {
+		return nil, nil
+	}
+
+	clientAuth, err := parseClientAuth(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &serverConfig{
+		config:     config,
+		clientAuth: clientAuth,
+		interval:   reloadInterval,
+	}
+
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: s.getConfigForClient,
+	}, nil
+}
+
+func parseClientAuth(config cfg.TLS) (tls.ClientAuthType, error) {
+	switch config.ClientAuth {
+	case "":
+		if config.ClientCAFile == "" {
+			return tls.NoClientCert, nil
+		}
+
+		return tls.RequireAndVerifyClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("unknown client_auth %q", config.ClientAuth)
+}
+
+type serverConfig struct {
+	config     cfg.TLS
+	clientAuth tls.ClientAuthType
+	interval   time.Duration
+
+	mu        sync.Mutex
+	current   *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+func (s *serverConfig) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.checkedAt) >= s.interval {
+		// Keep serving the old certificate if the new one is broken,
+		// e.g. the key is not yet written while rotating
+		if err := s.load(); err != nil {
+			log.WithError(err).Warn("tls reload error")
+		}
+	}
+
+	return s.current, nil
+}
+
+// Reads the files if they were modified since the last load
+func (s *serverConfig) load() error {
+	s.checkedAt = time.Now()
+
+	files := []string{s.config.CertFile, s.config.KeyFile}
+	if s.config.ClientCAFile != "" {
+		files = append(files, s.config.ClientCAFile)
+	}
+
+	modTimes, err := modTimes(files)
+	if err != nil {
+		return err
+	}
+
+	if s.current != nil && equalTimes(modTimes, s.modTimes) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   s.clientAuth,
+	}
+
+	if s.config.ClientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(s.config.ClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	if s.current != nil {
+		log.WithField("cert_file", s.config.CertFile).Info("TLS certificate reloaded")
+	}
+
+	s.current = config
+	s.modTimes = modTimes
+
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+func modTimes(files []string) ([]time.Time, error) {
+	times := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		times[i] = info.ModTime()
+	}
+
+	return times, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Writes a self-signed certificate and its key
+func writeCert(t *testing.T, certFile, keyFile, cn string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM(t, certFile, "CERTIFICATE", der, modTime)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer, modTime)
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte, modTime time.Time) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func leafCN(t *testing.T, config *tls.Config) string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+
+	config, err := Server(cfg.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	current, _ := config.GetConfigForClient(nil)
+	if cn := leafCN(t, current); cn != "first" {
+		t.Errorf("expected the first certificate: %s", cn)
+	}
+	if current.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("expected client certificates to be required with client CA")
+	}
+
+	writeCert(t, certFile, keyFile, "second", time.Now())
+
+	current, _ = config.GetConfigForClient(nil)
+	if cn := leafCN(t, current); cn != "first" {
+		t.Errorf("expected the certificate not to be reloaded before the interval: %s", cn)
+	}
+
+	s := &serverConfig{
+		config: cfg.TLS{CertFile: certFile, KeyFile: keyFile},
+	}
+	if err = s.load(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	writeCert(t, certFile, keyFile, "third", time.Now().Add(time.Minute))
+
+	current, _ = s.getConfigForClient(nil)
+	if cn := leafCN(t, current); cn != "third" {
+		t.Errorf("expected the rotated certificate to be loaded: %s", cn)
+	}
+}
+
+func TestServerDisabled(t *testing.T) {
+	config, err := Server(cfg.TLS{})
+	if config != nil || err != nil {
+		t.Errorf("expected no TLS config without certificate")
+	}
+
+	if _, err = Server(cfg.TLS{CertFile: "a", KeyFile: "b", ClientAuth: "maybe"}); err == nil {
+		t.Errorf("expected unknown client_auth to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Projects the JSON fields into a new object.
+// Paths are dot-separated, array elements are addressed by index:
+// data.items.0.id
+type jsonStep struct {
+	fields []cfg.FieldMapping
+}
+
+func (s *jsonStep) apply(_ http.Header, body []byte) ([]byte, string, error) {
+	var input interface{}
+	if err := json.Unmarshal(body, &input); err != nil {
+		return nil, "", fmt.Errorf("invalid JSON: %s", err)
+	}
+
+	output := map[string]interface{}{}
+	for _, field := range s.fields {
+		value, ok := lookup(input, field.From)
+		if !ok {
+			continue
+		}
+
+		to := field.To
+		if to == "" {
+			to = field.From
+		}
+
+		if err := assign(output, to, value); err != nil {
+			return nil, "", err
+		}
+	}
+
+	result, err := json.Marshal(output)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, jsonContentType, nil
+}
+
+// Lookup finds the value by the dot-separated path
+func lookup(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// Sets the value by the dot-separated path creating nested objects
+func assign(output map[string]interface{}, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	node := output
+
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := node[key]
+		if !ok {
+			child := map[string]interface{}{}
+			node[key] = child
+			node = child
+			continue
+		}
+
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("field %s conflicts with %s", path, key)
+		}
+		node = child
+	}
+
+	node[keys[len(keys)-1]] = value
+
+	return nil
+}
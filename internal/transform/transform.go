@@ -0,0 +1,158 @@
+// Package transform changes the shape of the request bodies
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	// Transform the body before putting the request into the queue
+	StageEnqueue = "enqueue"
+
+	// Transform the body right before sending the request
+	StageDelivery = "delivery"
+
+	TypeJSON      = "json"
+	TypeXMLToJSON = "xml_to_json"
+	TypeTemplate  = "template"
+
+	jsonContentType = "application/json"
+)
+
+// Error tells which step of the pipeline failed
+type Error struct {
+	Step int
+	Type string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("transform step #%d (%s): %s", e.Step, e.Type, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Pipeline applies the steps to the body one by one
+type Pipeline struct {
+	Stage string
+
+	steps []step
+	types []string
+}
+
+type step interface {
+	// Returns the new body and its content type, empty if it is unchanged
+	apply(header http.Header, body []byte) ([]byte, string, error)
+}
+
+// New returns nil if no steps configured
+func New(config cfg.Transform) (*Pipeline, error) {
+	if len(config.Steps) == 0 {
+		return nil, nil
+	}
+
+	p := &Pipeline{Stage: config.Stage}
+
+	switch p.Stage {
+	case "":
+		p.Stage = StageDelivery
+	case StageEnqueue, StageDelivery:
+	default:
+		return nil, fmt.Errorf("unknown transform stage %q", config.Stage)
+	}
+
+	for i, sc := range config.Steps {
+		s, err := newStep(sc)
+		if err != nil {
+			return nil, &Error{Step: i + 1, Type: sc.Type, Err: err}
+		}
+
+		p.steps = append(p.steps, s)
+		p.types = append(p.types, sc.Type)
+	}
+
+	return p, nil
+}
+
+func newStep(sc cfg.TransformStep) (step, error) {
+	switch sc.Type {
+	case TypeJSON:
+		if len(sc.Fields) == 0 {
+			return nil, fmt.Errorf("fields are required")
+		}
+
+		return &jsonStep{fields: sc.Fields}, nil
+	case TypeXMLToJSON:
+		return &xmlToJSONStep{}, nil
+	case TypeTemplate:
+		tmpl, err := template.New("body").
+			Option("missingkey=zero").
+			Funcs(template.FuncMap{"toJSON": toJSON}).
+			Parse(sc.Template)
+		if err != nil {
+			return nil, err
+		}
+
+		return &templateStep{tmpl: tmpl, contentType: sc.ContentType}, nil
+	}
+
+	return nil, fmt.Errorf("unknown type")
+}
+
+// Apply runs the pipeline and updates the Content-Type header.
+// The header is modified in place.
+func (p *Pipeline) Apply(header http.Header, body []byte) ([]byte, error) {
+	for i, s := range p.steps {
+		result, contentType, err := s.apply(header, body)
+		if err != nil {
+			return nil, &Error{Step: i + 1, Type: p.types[i], Err: err}
+		}
+
+		body = result
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+
+	return body, nil
+}
+
+// Renders the body with a Go template
+type templateStep struct {
+	tmpl        *template.Template
+	contentType string
+}
+
+// Variables available in the body template
+type templateData struct {
+	Body   string
+	JSON   interface{}
+	Header http.Header
+}
+
+func (s *templateStep) apply(header http.Header, body []byte) ([]byte, string, error) {
+	data := templateData{Body: string(body), Header: header}
+
+	// Not every body is JSON, templates can work with the raw one
+	_ = json.Unmarshal(body, &data.JSON)
+
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), s.contentType, nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
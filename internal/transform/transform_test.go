@@ -0,0 +1,106 @@
+package transform
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func apply(t *testing.T, steps []cfg.TransformStep, body string) (string, http.Header) {
+	t.Helper()
+
+	p, err := New(cfg.Transform{Steps: steps})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	header := http.Header{"Content-Type": {"text/plain"}}
+	result, err := p.Apply(header, []byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return string(result), header
+}
+
+func TestJSON(t *testing.T) {
+	result, header := apply(t, []cfg.TransformStep{{
+		Type: TypeJSON,
+		Fields: []cfg.FieldMapping{
+			{From: "type"},
+			{From: "data.object.id", To: "invoice.id"},
+			{From: "data.lines.1.amount", To: "invoice.amount"},
+			{From: "data.missing", To: "missing"},
+		},
+	}}, `{"type":"invoice.paid","data":{"object":{"id":"in_1"},"lines":[{"amount":1},{"amount":2}]}}`)
+
+	if result != `{"invoice":{"amount":2,"id":"in_1"},"type":"invoice.paid"}` {
+		t.Errorf("unexpected result: %s", result)
+	}
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected JSON content type: %s", header.Get("Content-Type"))
+	}
+}
+
+func TestXMLToJSON(t *testing.T) {
+	result, _ := apply(t, []cfg.TransformStep{{Type: TypeXMLToJSON}},
+		`<order id="1" xmlns="urn:orders"><item>a</item><item>b</item><note lang="en">hi</note><empty/></order>`)
+
+	expected := `{"order":{"@id":"1","empty":"","item":["a","b"],"note":{"#text":"hi","@lang":"en"}}}`
+	if result != expected {
+		t.Errorf("unexpected result: %s", result)
+	}
+
+	body, err := os.ReadFile("../../testing/request.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, _ = apply(t, []cfg.TransformStep{{Type: TypeXMLToJSON}}, string(body)); result[:13] != `{"Envelope":{` {
+		t.Errorf("expected SOAP envelope to be converted: %.50s", result)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	result, header := apply(t, []cfg.TransformStep{
+		{Type: TypeXMLToJSON},
+		{
+			Type:        TypeTemplate,
+			Template:    `{"event":{{ toJSON .JSON.ping.event }},"raw":{{ toJSON .Body }}}`,
+			ContentType: "application/vnd.event+json",
+		},
+	}, `<ping><event>created</event></ping>`)
+
+	if result != `{"event":"created","raw":"{\"ping\":{\"event\":\"created\"}}"}` {
+		t.Errorf("unexpected result: %s", result)
+	}
+	if header.Get("Content-Type") != "application/vnd.event+json" {
+		t.Errorf("expected configured content type: %s", header.Get("Content-Type"))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	p, err := New(cfg.Transform{Steps: []cfg.TransformStep{
+		{Type: TypeTemplate, Template: "{{ .Body }}"},
+		{Type: TypeXMLToJSON},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = p.Apply(http.Header{}, []byte("not xml"))
+
+	var transformErr *Error
+	if !errors.As(err, &transformErr) || transformErr.Step != 2 || transformErr.Type != TypeXMLToJSON {
+		t.Errorf("expected the failed step to be reported: %v", err)
+	}
+
+	if _, err = New(cfg.Transform{Steps: []cfg.TransformStep{{Type: "yaml"}}}); err == nil {
+		t.Errorf("expected unknown step type to be rejected")
+	}
+	if _, err = New(cfg.Transform{Stage: "never", Steps: []cfg.TransformStep{{Type: TypeXMLToJSON}}}); err == nil {
+		t.Errorf("expected unknown stage to be rejected")
+	}
+}
@@ -0,0 +1,138 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Converts XML into JSON:
+//
+//	<order id="1"><item>a</item><item>b</item><note>hi</note></order>
+//
+// becomes
+//
+//	{"order":{"@id":"1","item":["a","b"],"note":"hi"}}
+//
+// Attributes are prefixed with @, text of the elements with attributes
+// or children is stored as #text, repeated elements become arrays.
+// Namespace prefixes and declarations are dropped.
+type xmlToJSONStep struct{}
+
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     strings.Builder
+}
+
+func (s *xmlToJSONStep) apply(_ http.Header, body []byte) ([]byte, string, error) {
+	root, err := parseXML(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid XML: %s", err)
+	}
+
+	result, err := json.Marshal(map[string]interface{}{root.name: root.value()})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, jsonContentType, nil
+}
+
+func parseXML(body []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	var (
+		root  *xmlNode
+		stack []*xmlNode
+	)
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: withoutNamespaces(t.Attr)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			} else {
+				return nil, fmt.Errorf("multiple root elements")
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+
+	return root, nil
+}
+
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+
+	if len(n.attrs) == 0 && len(n.children) == 0 {
+		return text
+	}
+
+	obj := make(map[string]interface{}, len(n.attrs)+len(n.children)+1)
+	for _, attr := range n.attrs {
+		obj["@"+attr.Name.Local] = attr.Value
+	}
+
+	for _, child := range n.children {
+		value := child.value()
+
+		existing, ok := obj[child.name]
+		if !ok {
+			obj[child.name] = value
+			continue
+		}
+
+		if list, ok := existing.([]interface{}); ok {
+			obj[child.name] = append(list, value)
+		} else {
+			obj[child.name] = []interface{}{existing, value}
+		}
+	}
+
+	if text != "" {
+		obj["#text"] = text
+	}
+
+	return obj
+}
+
+func withoutNamespaces(attrs []xml.Attr) []xml.Attr {
+	result := attrs[:0:0]
+	for _, attr := range attrs {
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+
+		result = append(result, attr)
+	}
+
+	return result
+}
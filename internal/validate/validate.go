@@ -0,0 +1,171 @@
+// Package validate checks the incoming requests against the route limits
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+var (
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrUnsupportedMediaType = errors.New("unsupported content type")
+)
+
+// MethodError lists the methods allowed for the route
+type MethodError struct {
+	Method  string
+	Allowed []string
+}
+
+func (e *MethodError) Error() string {
+	return fmt.Sprintf("method %s not allowed", e.Method)
+}
+
+// SchemaError is returned for the bodies not matching the JSON Schema
+type SchemaError struct {
+	Err error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("invalid body: %s", e.Err)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// Validator holds the limits of the route
+type Validator struct {
+	maxBodySize  int64
+	methods      []string
+	contentTypes []string
+	schema       *jsonschema.Schema
+}
+
+// New returns nil if no limits configured. The route body size limit
+// defaults to maxBodySize.
+func New(config cfg.Validate, maxBodySize int64) (*Validator, error) {
+	v := &Validator{
+		maxBodySize:  config.MaxBodySize,
+		contentTypes: config.ContentTypes,
+	}
+
+	if v.maxBodySize == 0 {
+		v.maxBodySize = maxBodySize
+	}
+
+	for _, method := range config.Methods {
+		v.methods = append(v.methods, strings.ToUpper(method))
+	}
+
+	if config.Schema != "" {
+		schema, err := jsonschema.Compile(config.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %s", config.Schema, err)
+		}
+		v.schema = schema
+	}
+
+	if v.maxBodySize <= 0 && len(v.methods) == 0 && len(v.contentTypes) == 0 && v.schema == nil {
+		return nil, nil
+	}
+
+	return v, nil
+}
+
+// Check validates the method and the content type and limits the body size.
+// The body is replaced with the reader failing with *http.MaxBytesError
+// after the limit, so the body should be read after the check.
+func (v *Validator) Check(w http.ResponseWriter, r *http.Request) error {
+	if len(v.methods) > 0 && !contains(v.methods, r.Method) {
+		return &MethodError{Method: r.Method, Allowed: v.methods}
+	}
+
+	if len(v.contentTypes) > 0 && r.ContentLength != 0 {
+		if !v.allowedContentType(r.Header.Get("Content-Type")) {
+			return ErrUnsupportedMediaType
+		}
+	}
+
+	if v.maxBodySize > 0 {
+		if r.ContentLength > v.maxBodySize {
+			return ErrBodyTooLarge
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, v.maxBodySize)
+	}
+
+	return nil
+}
+
+// Validate checks the size of the read body and validates it against
+// the JSON Schema if configured
+func (v *Validator) Validate(body []byte) error {
+	if v.maxBodySize > 0 && int64(len(body)) > v.maxBodySize {
+		return ErrBodyTooLarge
+	}
+
+	if v.schema == nil {
+		return nil
+	}
+
+	// Numbers are kept as is to validate big integers precisely
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return &SchemaError{Err: err}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return &SchemaError{Err: errors.New("unexpected data after JSON")}
+	}
+
+	if err := v.schema.Validate(doc); err != nil {
+		return &SchemaError{Err: err}
+	}
+
+	return nil
+}
+
+// Content types are matched without parameters, type/* matches any subtype
+func (v *Validator) allowedContentType(header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range v.contentTypes {
+		allowed = strings.ToLower(allowed)
+
+		if allowed == mediaType {
+			return true
+		}
+
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,138 @@
+package validate
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestCheck(t *testing.T) {
+	v, err := New(cfg.Validate{
+		Methods:      []string{"post", "PUT"},
+		ContentTypes: []string{"application/json", "text/*"},
+	}, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		method      string
+		contentType string
+		body        string
+		err         error
+	}{
+		{"POST", "application/json; charset=utf-8", "{}", nil},
+		{"PUT", "text/plain", "hello", nil},
+		{"GET", "application/json", "{}", &MethodError{}},
+		{"POST", "application/xml", "<a/>", ErrUnsupportedMediaType},
+		{"POST", "", "{}", ErrUnsupportedMediaType},
+		{"POST", "", "", nil},
+		{"POST", "application/json", `{"a":"long"}`, ErrBodyTooLarge},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/", strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+
+		err := v.Check(httptest.NewRecorder(), r)
+
+		switch expected := c.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s %s: unexpected error: %s", c.method, c.contentType, err)
+			}
+		case *MethodError:
+			var methodErr *MethodError
+			if !errors.As(err, &methodErr) {
+				t.Errorf("%s: expected method error, got %v", c.method, err)
+			} else if strings.Join(methodErr.Allowed, ",") != "POST,PUT" {
+				t.Errorf("expected allowed methods: %v", methodErr.Allowed)
+			}
+		default:
+			if !errors.Is(err, expected) {
+				t.Errorf("%s %s: expected %v, got %v", c.method, c.contentType, expected, err)
+			}
+		}
+	}
+}
+
+func TestCheckLimitsUnknownLength(t *testing.T) {
+	v, err := New(cfg.Validate{}, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+
+	if err = v.Check(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = ioutil.ReadAll(r.Body)
+	if !errors.As(err, new(*http.MaxBytesError)) {
+		t.Errorf("expected body to be limited, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "event.json")
+	err := os.WriteFile(schema, []byte(`{
+		"type": "object",
+		"required": ["type"],
+		"properties": {"type": {"enum": ["created", "deleted"]}}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := New(cfg.Validate{Schema: schema}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err = v.Validate([]byte(`{"type":"created"}`)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for _, body := range []string{`{"type":"updated"}`, `{}`, `not json`, `{"type":"created"} {}`} {
+		if err = v.Validate([]byte(body)); !errors.As(err, new(*SchemaError)) {
+			t.Errorf("%s: expected schema error, got %v", body, err)
+		}
+	}
+}
+
+func TestValidateSize(t *testing.T) {
+	v, err := New(cfg.Validate{}, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err = v.Validate([]byte("1234")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err = v.Validate([]byte("12345")); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected body too large, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	v, err := New(cfg.Validate{}, 0)
+	if err != nil || v != nil {
+		t.Errorf("expected no validator: %v, %v", v, err)
+	}
+
+	if _, err = New(cfg.Validate{Schema: "missing.json"}, 0); err == nil {
+		t.Errorf("expected missing schema to be rejected")
+	}
+}
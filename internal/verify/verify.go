@@ -0,0 +1,223 @@
+// Package verify checks signatures of the incoming webhooks
+package verify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	TypeHMAC   = "hmac"
+	TypeGitHub = "github"
+	TypeStripe = "stripe"
+	TypeSlack  = "slack"
+
+	defaultHeader    = "X-Signature"
+	defaultTolerance = 5 * time.Minute
+)
+
+var (
+	// All verification errors wrap this one
+	ErrUnauthorized = errors.New("unauthorized")
+
+	errMissingSignature = fmt.Errorf("%w: missing signature", ErrUnauthorized)
+	errInvalidSignature = fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	errInvalidTimestamp = fmt.Errorf("%w: invalid timestamp", ErrUnauthorized)
+	errExpiredTimestamp = fmt.Errorf("%w: timestamp is out of tolerance", ErrUnauthorized)
+)
+
+// Verifier checks that the request was signed by the trusted sender
+type Verifier interface {
+	Verify(header http.Header, body []byte) error
+}
+
+// New returns the verifier for the config or nil if verification
+// is not configured.
+func New(config cfg.Verify) (Verifier, error) {
+	if config.Type == "" {
+		return nil, nil
+	}
+
+	if config.Secret == "" {
+		return nil, fmt.Errorf("%s verification requires a secret", config.Type)
+	}
+
+	secret := []byte(config.Secret)
+
+	tolerance := config.Tolerance
+	if tolerance == 0 {
+		tolerance = defaultTolerance
+	}
+
+	switch config.Type {
+	case TypeHMAC:
+		header := config.Header
+		if header == "" {
+			header = defaultHeader
+		}
+
+		var encode func([]byte) string
+		switch config.Encoding {
+		case "", "hex":
+			encode = hex.EncodeToString
+		case "base64":
+			encode = base64.StdEncoding.EncodeToString
+		default:
+			return nil, fmt.Errorf("unknown signature encoding %q", config.Encoding)
+		}
+
+		return &hmacVerifier{
+			secret: secret,
+			header: header,
+			prefix: config.Prefix,
+			encode: encode,
+		}, nil
+	case TypeGitHub:
+		return &hmacVerifier{
+			secret: secret,
+			header: "X-Hub-Signature-256",
+			prefix: "sha256=",
+			encode: hex.EncodeToString,
+		}, nil
+	case TypeStripe:
+		return &stripeVerifier{secret: secret, tolerance: tolerance, now: time.Now}, nil
+	case TypeSlack:
+		return &slackVerifier{secret: secret, tolerance: tolerance, now: time.Now}, nil
+	}
+
+	return nil, fmt.Errorf("unknown verification type %q", config.Type)
+}
+
+// HMAC-SHA256 of the body sent in the header
+type hmacVerifier struct {
+	secret []byte
+	header string
+	prefix string
+	encode func([]byte) string
+}
+
+func (v *hmacVerifier) Verify(header http.Header, body []byte) error {
+	signature := header.Get(v.header)
+	if signature == "" {
+		return errMissingSignature
+	}
+
+	expected := v.prefix + v.encode(sign(v.secret, body))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidSignature
+	}
+
+	return nil
+}
+
+// Stripe-Signature: t=<unix>,v1=<hex hmac of "t.body">[,v1=...]
+type stripeVerifier struct {
+	secret    []byte
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+func (v *stripeVerifier) Verify(header http.Header, body []byte) error {
+	value := header.Get("Stripe-Signature")
+	if value == "" {
+		return errMissingSignature
+	}
+
+	var (
+		timestamp  string
+		signatures []string
+	)
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	if len(signatures) == 0 {
+		return errMissingSignature
+	}
+
+	if err := checkTimestamp(timestamp, v.now(), v.tolerance); err != nil {
+		return err
+	}
+
+	expected := hex.EncodeToString(sign(v.secret, []byte(timestamp+"."), body))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+
+	return errInvalidSignature
+}
+
+// X-Slack-Signature: v0=<hex hmac of "v0:<timestamp>:body">
+type slackVerifier struct {
+	secret    []byte
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+func (v *slackVerifier) Verify(header http.Header, body []byte) error {
+	signature := header.Get("X-Slack-Signature")
+	if signature == "" {
+		return errMissingSignature
+	}
+
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	if err := checkTimestamp(timestamp, v.now(), v.tolerance); err != nil {
+		return err
+	}
+
+	expected := "v0=" + hex.EncodeToString(sign(v.secret, []byte("v0:"+timestamp+":"), body))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidSignature
+	}
+
+	return nil
+}
+
+func sign(secret []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+
+	return mac.Sum(nil)
+}
+
+// Protects from replaying old requests
+func checkTimestamp(timestamp string, now time.Time, tolerance time.Duration) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidTimestamp
+	}
+
+	diff := now.Sub(time.Unix(unix, 0))
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return errExpiredTimestamp
+	}
+
+	return nil
+}
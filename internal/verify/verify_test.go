@@ -0,0 +1,122 @@
+package verify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+var (
+	secret = "s3cr3t"
+	body   = []byte(`{"event":"ping"}`)
+	now    = time.Unix(1700000000, 0)
+)
+
+func hexHMAC(payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newVerifier(t *testing.T, config cfg.Verify) Verifier {
+	t.Helper()
+
+	config.Secret = secret
+	v, err := New(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	switch tv := v.(type) {
+	case *stripeVerifier:
+		tv.now = func() time.Time { return now }
+	case *slackVerifier:
+		tv.now = func() time.Time { return now }
+	}
+
+	return v
+}
+
+func TestHMAC(t *testing.T) {
+	v := newVerifier(t, cfg.Verify{Type: TypeHMAC, Header: "X-Sig", Prefix: "sha256="})
+
+	header := http.Header{}
+	if err := v.Verify(header, body); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected missing signature to be rejected: %v", err)
+	}
+
+	header.Set("X-Sig", "sha256="+hexHMAC("tampered"))
+	if err := v.Verify(header, body); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected invalid signature to be rejected: %v", err)
+	}
+
+	header.Set("X-Sig", "sha256="+hexHMAC(string(body)))
+	if err := v.Verify(header, body); err != nil {
+		t.Errorf("expected valid signature to pass: %s", err)
+	}
+}
+
+func TestGitHub(t *testing.T) {
+	v := newVerifier(t, cfg.Verify{Type: TypeGitHub})
+
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", "sha256="+hexHMAC(string(body)))
+	if err := v.Verify(header, body); err != nil {
+		t.Errorf("expected valid signature to pass: %s", err)
+	}
+}
+
+func TestStripe(t *testing.T) {
+	v := newVerifier(t, cfg.Verify{Type: TypeStripe})
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	header := http.Header{}
+	header.Set("Stripe-Signature", "t="+ts+",v1=deadbeef,v1="+hexHMAC(ts+"."+string(body)))
+	if err := v.Verify(header, body); err != nil {
+		t.Errorf("expected valid signature to pass: %s", err)
+	}
+
+	old := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	header.Set("Stripe-Signature", "t="+old+",v1="+hexHMAC(old+"."+string(body)))
+	if err := v.Verify(header, body); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected expired timestamp to be rejected: %v", err)
+	}
+}
+
+func TestSlack(t *testing.T) {
+	v := newVerifier(t, cfg.Verify{Type: TypeSlack, Tolerance: time.Minute})
+	ts := strconv.FormatInt(now.Add(-30*time.Second).Unix(), 10)
+
+	header := http.Header{}
+	header.Set("X-Slack-Request-Timestamp", ts)
+	header.Set("X-Slack-Signature", "v0="+hexHMAC("v0:"+ts+":"+string(body)))
+	if err := v.Verify(header, body); err != nil {
+		t.Errorf("expected valid signature to pass: %s", err)
+	}
+
+	header.Set("X-Slack-Request-Timestamp", "not a number")
+	if err := v.Verify(header, body); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected invalid timestamp to be rejected: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if v, err := New(cfg.Verify{}); v != nil || err != nil {
+		t.Errorf("expected no verifier without type")
+	}
+
+	if _, err := New(cfg.Verify{Type: TypeGitHub}); err == nil {
+		t.Errorf("expected missing secret to be rejected")
+	}
+
+	if _, err := New(cfg.Verify{Type: "md5", Secret: secret}); err == nil {
+		t.Errorf("expected unknown type to be rejected")
+	}
+}
@@ -0,0 +1,183 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	defaultAdaptiveMin       = 1
+	defaultAdaptiveInitial   = 10
+	defaultAdaptiveTolerance = 2.0
+	defaultAdaptiveBackoff   = 0.9
+
+	// How long the lowest latency is remembered
+	adaptiveBaselineWindow = time.Minute
+)
+
+var upstreamConcurrencyLimitGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "upstream_concurrency_limit",
+	Help: "Current adaptive concurrency limit of the upstream.",
+}, []string{"upstream"})
+
+// Concurrency limit adjusted by AIMD: it grows by one per limit
+// of the successful requests while the latency stays within the tolerance
+// of the lowest one seen, and is multiplied by backoff when the latency
+// rises or the requests fail.
+type adaptiveLimit struct {
+	name      string
+	min, max  float64
+	tolerance float64
+	backoff   float64
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+
+	// Closed and replaced when a request is done
+	released chan struct{}
+
+	// Lowest latency of the current and the previous windows
+	baseline     time.Duration
+	prevBaseline time.Duration
+	windowStart  time.Time
+
+	// Requests started before the decrease don't decrease it again
+	decreasedAt time.Time
+
+	now func() time.Time
+}
+
+func newAdaptiveLimit(name string, config cfg.Adaptive, max int) (*adaptiveLimit, error) {
+	a := &adaptiveLimit{
+		name:      name,
+		min:       float64(config.Min),
+		max:       float64(max),
+		limit:     float64(config.Initial),
+		tolerance: config.Tolerance,
+		backoff:   config.Backoff,
+		released:  make(chan struct{}),
+		now:       time.Now,
+	}
+
+	if a.min == 0 {
+		a.min = defaultAdaptiveMin
+	}
+	if a.limit == 0 {
+		a.limit = math.Max(a.min, math.Min(defaultAdaptiveInitial, a.max))
+	}
+	if a.tolerance == 0 {
+		a.tolerance = defaultAdaptiveTolerance
+	}
+	if a.backoff == 0 {
+		a.backoff = defaultAdaptiveBackoff
+	}
+
+	switch {
+	case a.min < 1 || a.min > a.max:
+		return nil, fmt.Errorf("upstream %s: adaptive min must be between 1 and %d", name, max)
+	case a.limit < a.min || a.limit > a.max:
+		return nil, fmt.Errorf("upstream %s: adaptive initial must be between min and %d", name, max)
+	case a.tolerance <= 1:
+		return nil, fmt.Errorf("upstream %s: adaptive tolerance must be > 1", name)
+	case a.backoff <= 0 || a.backoff >= 1:
+		return nil, fmt.Errorf("upstream %s: adaptive backoff must be between 0 and 1", name)
+	}
+
+	a.windowStart = a.now()
+	upstreamConcurrencyLimitGauge.WithLabelValues(name).Set(a.limit)
+
+	return a, nil
+}
+
+// Waits until the number of requests in flight is below the limit,
+// returns the number including the request
+func (a *adaptiveLimit) acquire(ctx context.Context) (int, error) {
+	for {
+		a.mu.Lock()
+		if a.inFlight < int(a.limit) {
+			a.inFlight++
+			inFlight := a.inFlight
+			a.mu.Unlock()
+			return inFlight, nil
+		}
+		released := a.released
+		a.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Frees the slot of the request which wasn't sent
+func (a *adaptiveLimit) cancel() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.free()
+}
+
+func (a *adaptiveLimit) free() {
+	a.inFlight--
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// Frees the slot of the request sent with inFlight requests
+// and adjusts the limit by its outcome
+func (a *adaptiveLimit) release(start time.Time, inFlight int, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.free()
+
+	now := a.now()
+	latency := now.Sub(start)
+
+	if now.Sub(a.windowStart) > adaptiveBaselineWindow {
+		a.prevBaseline, a.baseline = a.baseline, 0
+		a.windowStart = now
+	}
+	if !failed && (a.baseline == 0 || latency < a.baseline) {
+		a.baseline = latency
+	}
+
+	baseline := a.baseline
+	if a.prevBaseline != 0 && (baseline == 0 || a.prevBaseline < baseline) {
+		baseline = a.prevBaseline
+	}
+
+	congested := failed || baseline > 0 && float64(latency) > a.tolerance*float64(baseline)
+
+	switch {
+	case congested && start.After(a.decreasedAt):
+		a.limit = math.Max(a.min, a.limit*a.backoff)
+		a.decreasedAt = now
+	case congested:
+		return
+	case float64(inFlight)*2 >= a.limit:
+		// Grows only when the limit is used
+		a.limit = math.Min(a.max, a.limit+1/a.limit)
+	}
+
+	upstreamConcurrencyLimitGauge.WithLabelValues(a.name).Set(math.Floor(a.limit))
+}
+
+// Reports whether the requests would have to wait
+func (a *adaptiveLimit) saturated() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.inFlight >= int(a.limit)
+}
@@ -0,0 +1,116 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestAdaptiveLimit(t *testing.T) {
+	a, err := newAdaptiveLimit("api", cfg.Adaptive{Initial: 4}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	// Sends the requests at the limit taking the latency
+	round := func(latency time.Duration, failed bool) {
+		t.Helper()
+
+		now = now.Add(time.Millisecond)
+
+		n := int(a.limit)
+		start := now
+		for i := 0; i < n; i++ {
+			if _, err := a.acquire(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !a.saturated() {
+			t.Fatalf("expected limit %d to be saturated", n)
+		}
+
+		now = now.Add(latency)
+		for i := 0; i < n; i++ {
+			a.release(start, n, failed)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		round(10*time.Millisecond, false)
+	}
+	if int(a.limit) != 7 {
+		t.Errorf("expected limit to grow to 7, got %.2f", a.limit)
+	}
+
+	for i := 0; i < 4; i++ {
+		round(10*time.Millisecond, false)
+	}
+	if a.limit != 8 {
+		t.Errorf("expected limit to stop at max, got %.2f", a.limit)
+	}
+
+	// Decreases once per the requests sent before
+	round(50*time.Millisecond, false)
+	if a.limit != 7.2 {
+		t.Errorf("expected limit to decrease on latency, got %.2f", a.limit)
+	}
+
+	round(10*time.Millisecond, true)
+	if int(a.limit) != 6 {
+		t.Errorf("expected limit to decrease on errors, got %.2f", a.limit)
+	}
+
+	for i := 0; i < 40; i++ {
+		round(10*time.Millisecond, true)
+	}
+	if a.limit != 1 {
+		t.Errorf("expected limit to stop at min, got %.2f", a.limit)
+	}
+}
+
+func TestAdaptiveLimitWait(t *testing.T) {
+	a, err := newAdaptiveLimit("api", cfg.Adaptive{Initial: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		_, err := a.acquire(context.Background())
+		acquired <- err
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected to wait for the slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	a.cancel()
+
+	if err = <-acquired; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewAdaptiveLimitErrors(t *testing.T) {
+	for _, config := range []cfg.Adaptive{
+		{Min: 20},
+		{Initial: 20},
+		{Tolerance: 0.5},
+		{Backoff: 1.5},
+	} {
+		if _, err := newAdaptiveLimit("api", config, 10); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
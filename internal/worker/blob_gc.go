@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/blob"
+)
+
+const (
+	selectBodyRefsSQL = `
+    SELECT body_ref FROM proxy_requests WHERE body_ref = ANY($1::varchar[]);
+  `
+
+	defaultBlobGCInterval = time.Hour
+	defaultBlobGCGrace    = time.Hour
+)
+
+var blobGCDeletedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "queue_blob_gc_deleted_total",
+	Help: "Number of orphaned blobs deleted by the garbage collection.",
+})
+
+// Deletes the blobs no queued request points to. They are left when
+// the service stops between dequeueing and completing the request
+// or when the request fails to be inserted after its blob is stored.
+type blobCollector struct {
+	db    *sql.DB
+	blobs blob.Store
+
+	interval time.Duration
+
+	// Age of the blobs to be checked, so the ones being enqueued
+	// are not deleted before their rows are committed
+	grace time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBlobCollector(db *sql.DB, blobs blob.Store, config cfg.Blob) (*blobCollector, error) {
+	c := &blobCollector{
+		db:       db,
+		blobs:    blobs,
+		interval: config.GCInterval,
+		grace:    config.GCGrace,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if c.interval == 0 {
+		c.interval = defaultBlobGCInterval
+	}
+	if c.grace == 0 {
+		c.grace = defaultBlobGCGrace
+	}
+	if c.interval < 0 || c.grace < 0 {
+		return nil, fmt.Errorf("blob gc interval and grace must be >= 0")
+	}
+
+	go c.run()
+
+	return c, nil
+}
+
+func (c *blobCollector) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if _, err := c.collect(context.Background()); err != nil {
+				log.WithError(err).Error("blob gc error")
+			}
+		}
+	}
+}
+
+func (c *blobCollector) Shutdown() {
+	close(c.stop)
+	<-c.done
+}
+
+// Deletes the blobs older than the grace period without the requests,
+// returns the number of deleted blobs
+func (c *blobCollector) collect(ctx context.Context) (int, error) {
+	deleted := 0
+
+	err := c.blobs.List(ctx, time.Now().Add(-c.grace), func(keys []string) error {
+		referenced, err := c.referenced(ctx, keys)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if referenced[key] {
+				continue
+			}
+
+			if err = c.blobs.Delete(ctx, key); err != nil {
+				return err
+			}
+
+			deleted++
+			blobGCDeletedCounter.Inc()
+		}
+
+		return nil
+	})
+
+	if deleted > 0 {
+		log.WithField("deleted", deleted).Info("Deleted orphaned blobs")
+	}
+
+	return deleted, err
+}
+
+// Returns the keys the queued requests point to
+func (c *blobCollector) referenced(ctx context.Context, keys []string) (map[string]bool, error) {
+	rows, err := c.db.QueryContext(ctx, selectBodyRefsSQL, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		referenced[key] = true
+	}
+
+	return referenced, rows.Err()
+}
@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	defaultRetryBudgetWindow = 10 * time.Second
+	defaultRetryBudgetDefer  = time.Minute
+)
+
+var (
+	retryBudgetFreshCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_budget_fresh_total",
+		Help: "Number of first delivery attempts adding to the retry budget.",
+	}, []string{"destination"})
+
+	retryBudgetRetriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_budget_retries_total",
+		Help: "Number of failed requests retried within the budget or deferred.",
+	}, []string{"destination", "result"})
+
+	retryBudgetRemainingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "retry_budget_remaining",
+		Help: "Number of retries left in the budget of the current window.",
+	}, []string{"destination"})
+)
+
+// Retry budgets of the destinations, so the failing upstream
+// doesn't use up the retries of the others
+type retryBudgets struct {
+	config cfg.RetryBudget
+
+	mu      sync.Mutex
+	budgets map[string]*retryBudget
+}
+
+// Returns nil if the budget is not configured
+func newRetryBudgets(config cfg.RetryBudget) (*retryBudgets, error) {
+	b, err := newRetryBudget(config, "")
+	if b == nil || err != nil {
+		return nil, err
+	}
+
+	return &retryBudgets{config: config, budgets: map[string]*retryBudget{}}, nil
+}
+
+// Returns the budget of the upstream, destinations are the upstream
+// names, so their number is bounded
+func (b *retryBudgets) get(destination string) *retryBudget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	budget, ok := b.budgets[destination]
+	if !ok {
+		// The config is validated already
+		budget, _ = newRetryBudget(b.config, destination)
+		b.budgets[destination] = budget
+	}
+
+	return budget
+}
+
+// Limits the retries to minRetries plus ratio of the first attempts
+// within the sliding window. The counts of the previous window are
+// weighted by its part still in the sliding one.
+type retryBudget struct {
+	destination string
+
+	ratio      float64
+	minRetries float64
+	window     time.Duration
+
+	// Delay of the failed requests when the budget is exhausted
+	deferDelay time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	fresh       float64
+	retries     float64
+	prevFresh   float64
+	prevRetries float64
+
+	now func() time.Time
+}
+
+// Returns nil if the budget is not configured
+func newRetryBudget(config cfg.RetryBudget, destination string) (*retryBudget, error) {
+	if config.Ratio == 0 && config.MinRetries == 0 {
+		return nil, nil
+	}
+
+	b := &retryBudget{
+		destination: destination,
+		ratio:       config.Ratio,
+		minRetries:  float64(config.MinRetries),
+		window:      config.Window,
+		deferDelay:  config.Defer,
+		now:         time.Now,
+	}
+
+	if b.window == 0 {
+		b.window = defaultRetryBudgetWindow
+	}
+	if b.deferDelay == 0 {
+		b.deferDelay = defaultRetryBudgetDefer
+	}
+
+	switch {
+	case b.ratio < 0 || b.minRetries < 0:
+		return nil, errors.New("retry budget ratio and min_retries must be >= 0")
+	case b.window < 0 || b.deferDelay < 0:
+		return nil, errors.New("retry budget window and defer must be >= 0")
+	}
+
+	b.windowStart = b.now()
+
+	return b, nil
+}
+
+// Adds the first delivery attempt to the budget
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fresh++
+	retryBudgetFreshCounter.WithLabelValues(b.destination).Inc()
+	retryBudgetRemainingGauge.WithLabelValues(b.destination).Set(b.remaining(b.now()))
+}
+
+// Takes a retry from the budget, reports whether it wasn't exhausted
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	allowed := b.remaining(now) >= 1
+	if allowed {
+		b.retries++
+		retryBudgetRetriesCounter.WithLabelValues(b.destination, "retried").Inc()
+	} else {
+		retryBudgetRetriesCounter.WithLabelValues(b.destination, "deferred").Inc()
+	}
+
+	retryBudgetRemainingGauge.WithLabelValues(b.destination).Set(b.remaining(now))
+
+	return allowed
+}
+
+// Number of retries left in the sliding window
+func (b *retryBudget) remaining(now time.Time) float64 {
+	elapsed := now.Sub(b.windowStart)
+	if elapsed >= b.window {
+		b.prevFresh, b.prevRetries = b.fresh, b.retries
+		if elapsed >= 2*b.window {
+			b.prevFresh, b.prevRetries = 0, 0
+		}
+
+		b.fresh, b.retries = 0, 0
+		b.windowStart = b.windowStart.Add(elapsed / b.window * b.window)
+		elapsed = now.Sub(b.windowStart)
+	}
+
+	weight := 1 - float64(elapsed)/float64(b.window)
+	fresh := b.fresh + weight*b.prevFresh
+	retries := b.retries + weight*b.prevRetries
+
+	return math.Max(0, math.Floor(b.minRetries+b.ratio*fresh-retries))
+}
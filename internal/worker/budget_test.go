@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b, err := newRetryBudget(cfg.RetryBudget{Ratio: 0.2, MinRetries: 1, Window: 10 * time.Second}, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	b.windowStart = now
+
+	withdraw := func(n int) (allowed int) {
+		for i := 0; i < n; i++ {
+			if b.withdraw() {
+				allowed++
+			}
+		}
+		return
+	}
+
+	if allowed := withdraw(3); allowed != 1 {
+		t.Errorf("expected min retries without fresh requests, got %d", allowed)
+	}
+
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	if allowed := withdraw(3); allowed != 2 {
+		t.Errorf("expected 2 retries per 10 fresh requests, got %d", allowed)
+	}
+
+	// Half of the previous window is still counted
+	now = now.Add(15 * time.Second)
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	if allowed := withdraw(5); allowed != 2 {
+		t.Errorf("expected the previous window to be weighted, got %d", allowed)
+	}
+
+	now = now.Add(time.Minute)
+	if allowed := withdraw(3); allowed != 1 {
+		t.Errorf("expected the budget to reset, got %d", allowed)
+	}
+}
+
+func TestNewRetryBudgetErrors(t *testing.T) {
+	if b, err := newRetryBudgets(cfg.RetryBudget{Window: time.Second}); b != nil || err != nil {
+		t.Errorf("expected no budget: %v", err)
+	}
+
+	for _, config := range []cfg.RetryBudget{
+		{Ratio: -1},
+		{Ratio: 0.1, MinRetries: -1},
+		{Ratio: 0.1, Defer: -time.Second},
+	} {
+		if _, err := newRetryBudgets(config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+func TestWorkDefersOverBudget(t *testing.T) {
+	q := testQueue{}
+	budgets, _ := newRetryBudgets(cfg.RetryBudget{MinRetries: 1, Defer: time.Minute})
+
+	worker := &Worker{
+		numWorkers:   1,
+		maxRetries:   10,
+		queue:        &q,
+		limiter:      rate.NewLimiter(rate.Limit(15), 15),
+		retryBudgets: budgets,
+	}
+
+	sendRequest := func(_ context.Context, r *Request) error {
+		return errors.New("any kind of error")
+	}
+
+	ctx := context.Background()
+	stopped := make(chan struct{}, 1)
+
+	worker.Work(ctx, stopped, sendRequest)
+	if q.enqueued != 1 || q.deferred != 0 {
+		t.Errorf("expected the request to be retried within the budget, deferred %s", q.deferred)
+	}
+
+	worker.Work(ctx, stopped, sendRequest)
+	if q.enqueued != 2 || q.deferred != time.Minute {
+		t.Errorf("expected the request to be deferred over the budget, deferred %s", q.deferred)
+	}
+}
+
+func TestRetryBudgetDestinations(t *testing.T) {
+	q := testQueue{destination: "flaky"}
+	budgets, _ := newRetryBudgets(cfg.RetryBudget{Ratio: 0.5, Defer: time.Minute})
+
+	worker := &Worker{
+		numWorkers:   1,
+		maxRetries:   10,
+		queue:        &q,
+		limiter:      rate.NewLimiter(rate.Inf, 1),
+		retryBudgets: budgets,
+	}
+
+	// Fresh requests sent directly to both upstreams
+	for _, destination := range []string{"flaky", "stable"} {
+		for i := 0; i < 4; i++ {
+			worker.Fresh(&Request{Meta: map[string]string{MetaDestination: destination}})
+		}
+	}
+
+	sendRequest := func(_ context.Context, r *Request) error {
+		return errors.New("any kind of error")
+	}
+
+	ctx := context.Background()
+	stopped := make(chan struct{}, 1)
+
+	// The flaky upstream uses up its own budget only
+	for i := 0; i < 3; i++ {
+		worker.Work(ctx, stopped, sendRequest)
+	}
+	if q.deferred != time.Minute {
+		t.Errorf("expected the flaky upstream retries to be deferred, deferred %s", q.deferred)
+	}
+
+	q.destination = "stable"
+	worker.Work(ctx, stopped, sendRequest)
+	if q.deferred != 0 {
+		t.Errorf("expected the stable upstream to keep its budget, deferred %s", q.deferred)
+	}
+}
+
+func TestRetryFailedDirectSend(t *testing.T) {
+	q := testQueue{}
+	budgets, _ := newRetryBudgets(cfg.RetryBudget{Ratio: 1, Defer: time.Minute})
+
+	worker := &Worker{
+		maxRetries:   10,
+		queue:        &q,
+		limiter:      rate.NewLimiter(rate.Inf, 1),
+		retryBudgets: budgets,
+	}
+
+	r := &Request{Meta: map[string]string{}}
+	worker.Fresh(r)
+
+	if err := worker.Retry(r); err != nil {
+		t.Fatal(err)
+	}
+	if q.attempt != 2 || q.deferred != 0 {
+		t.Errorf("expected the second attempt within the budget, got %d deferred %s", q.attempt, q.deferred)
+	}
+
+	// Dequeued as the second attempt, it isn't counted as fresh again
+	worker.Work(context.Background(), make(chan struct{}), func(context.Context, *Request) error {
+		return errors.New("any kind of error")
+	})
+	if q.deferred != time.Minute {
+		t.Errorf("expected the retry over the budget to be deferred, deferred %s", q.deferred)
+	}
+}
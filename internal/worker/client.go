@@ -2,34 +2,35 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"net/url"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 
 	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/route"
+	"github.com/evilmartians/asyncproxy/internal/transform"
 )
 
 // Client performs the requests
 // It controls the number of parallel requests made
 type Client struct {
-	client *http.Client
+	// Upstream for the routes without explicit one
+	upstream *upstream
 
-	openRequests sync.WaitGroup
+	upstreams map[string]*upstream
 
-	remoteHost, remoteScheme string
-}
+	router *route.Router
 
-func NewClient(config *cfg.Config) *Client {
-	remoteURL, err := url.Parse(config.Proxy.RemoteUrl)
-	if err != nil {
-		log.Fatal(err)
-	}
+	openRequests sync.WaitGroup
+}
 
+func NewClient(config *cfg.Config, router *route.Router) *Client {
 	log.WithFields(log.Fields{
-		"redirect_url":    fmt.Sprintf("%s://%s", remoteURL.Scheme, remoteURL.Host),
 		"max_open_fd":     config.Proxy.NumClients,
 		"request_timeout": config.Proxy.RequestTimeout,
 	}).Info("Initializing proxy")
@@ -38,20 +39,43 @@ func NewClient(config *cfg.Config) *Client {
 		log.Fatal("number of clients must be >= 1")
 	}
 
-	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defaultUpstream, err := newUpstream(cfg.Upstream{
+		Name:      "default",
+		RemoteUrl: config.Proxy.RemoteUrl,
+		TLS:       config.Proxy.TLS,
+		OAuth2:    config.Proxy.OAuth2,
+		Limits:    config.Proxy.Limits,
+	}, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := &Client{
+		upstream:  defaultUpstream,
+		upstreams: make(map[string]*upstream, len(config.Upstreams)),
+		router:    router,
+	}
+
+	for _, uc := range config.Upstreams {
+		if _, ok := c.upstreams[uc.Name]; ok || uc.Name == "" {
+			log.Fatalf("upstream name must be unique and not empty: %q", uc.Name)
+		}
 
-	// Limit open file descriptors
-	transport.MaxConnsPerHost = config.Proxy.NumClients
-	transport.MaxIdleConnsPerHost = config.Proxy.NumClients
+		u, err := newUpstream(uc, config)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	return &Client{
-		client: &http.Client{
-			Timeout:   config.Proxy.RequestTimeout,
-			Transport: transport,
-		},
-		remoteHost:   remoteURL.Host,
-		remoteScheme: remoteURL.Scheme,
+		c.upstreams[uc.Name] = u
 	}
+
+	for _, rt := range router.Routes() {
+		if _, ok := c.upstreams[rt.Upstream]; rt.Upstream != "" && !ok {
+			log.Fatalf("route %s: unknown upstream %q", rt.Name, rt.Upstream)
+		}
+	}
+
+	return c
 }
 
 // Shutdown gracefully waits for running requests to finish
@@ -73,35 +97,152 @@ func (c *Client) Shutdown(ctx context.Context) error {
 	}
 }
 
+// PermanentError is returned for the requests which would fail
+// the same way on every attempt, they are not retried
+type PermanentError struct {
+	Reason string
+	Err    error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
 // Sends the Request limiting the number of parallel requests
 func (c *Client) Do(ctx context.Context, r *Request) error {
 	c.openRequests.Add(1)
 	defer c.openRequests.Done()
 
-	httpReq, err := r.ToHTTPRequest(ctx, c.remoteHost, c.remoteScheme)
+	httpReq, u, err := c.newHTTPRequest(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	return u.do(httpReq)
+}
+
+// Stream sends the Request with the body read from the reader instead
+// of the Request one. The body is always closed, possibly after
+// the response is received.
+func (c *Client) Stream(ctx context.Context, r *Request, body io.ReadCloser, contentLength int64) error {
+	c.openRequests.Add(1)
+	defer c.openRequests.Done()
+
+	httpReq, u, err := c.newHTTPRequest(ctx, r)
 	if err != nil {
-		return fmt.Errorf("creating request: %s", err)
+		body.Close()
+		return err
+	}
+
+	// Can't be replayed on redirects and retries
+	httpReq.Body = body
+	httpReq.GetBody = nil
+	httpReq.ContentLength = contentLength
+
+	return u.do(httpReq)
+}
+
+// Prepares the outgoing request according to its route
+func (c *Client) newHTTPRequest(ctx context.Context, r *Request) (*http.Request, *upstream, error) {
+	reqURL, err := r.URL()
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating request: %s", err)
+	}
+
+	rt, u := c.match(reqURL.Path, r.Meta[MetaRoute])
+
+	if rt.Transform != nil && rt.Transform.Stage == transform.StageDelivery {
+		// The stored request is kept intact for the retries
+		transformed := *r
+		transformed.Header = r.Header.Clone()
+		if transformed.Body, err = rt.Transform.Apply(transformed.Header, r.Body); err != nil {
+			return nil, nil, &PermanentError{Reason: "transform", Err: err}
+		}
+		r = &transformed
+	}
+
+	httpReq, err := r.ToHTTPRequest(ctx, u.remoteHost, u.remoteScheme)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating request: %s", err)
+	}
+
+	if rt.Rewrite != nil {
+		rt.Rewrite.Apply(httpReq.URL)
+	}
+
+	if rt.Headers != nil {
+		if err = rt.Headers.Apply(httpReq.Header, r.headerData()); err != nil {
+			return nil, nil, fmt.Errorf("rewriting headers: %s", err)
+		}
+	}
+
+	if rt.Signer != nil {
+		rt.Signer.Sign(httpReq, r.ID, r.Body)
+	}
+
+	return httpReq, u, nil
+}
+
+// Destination returns the name of the upstream the request is sent to
+func (c *Client) Destination(r *Request) string {
+	reqURL, err := r.URL()
+	if err != nil {
+		return ""
+	}
+
+	_, u := c.match(reqURL.Path, r.Meta[MetaRoute])
+
+	return u.name
+}
+
+// Saturated returns the names of the upstreams at their limits
+func (c *Client) Saturated() []string {
+	var names []string
+
+	if c.upstream.limits.saturated() {
+		names = append(names, c.upstream.name)
+	}
+
+	for name, u := range c.upstreams {
+		if u.limits.saturated() {
+			names = append(names, name)
+		}
 	}
 
-	return c.do(httpReq)
+	return names
 }
 
-// Performs the HTTP requests.
-func (c *Client) do(r *http.Request) error {
+// Performs the HTTP requests within the upstream limits.
+func (u *upstream) do(r *http.Request) error {
+	release, err := u.limits.acquire(r.Context())
+	if err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return err
+	}
+
 	reqURL := r.URL.String()
 	log.WithFields(log.Fields{
 		"method": r.Method,
 		"url":    reqURL,
 	}).Info("proxying...")
 
-	resp, err := c.client.Do(r)
+	resp, err := u.client.Do(r)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
+		release(errorOutcome(r.Context(), err))
 		return fmt.Errorf("request error")
 	}
 
+	release(statusOutcome(resp.StatusCode))
+
 	log.WithFields(log.Fields{
 		"method": r.Method,
 		"url":    reqURL,
@@ -114,3 +255,149 @@ func (c *Client) do(r *http.Request) error {
 
 	return nil
 }
+
+// Forward reverse-proxies the request in real time streaming
+// the upstream status, headers and body back to the caller. The producer
+// is available in the header templates.
+func (c *Client) Forward(w http.ResponseWriter, r *http.Request, producer string) {
+	c.openRequests.Add(1)
+	defer c.openRequests.Done()
+
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"uri":    r.RequestURI,
+	}).Info("forwarding...")
+
+	rt, u := c.match(r.URL.Path, "")
+
+	// Context of the caller without the request timeout
+	ctx := r.Context()
+
+	release, err := u.limits.acquire(ctx)
+	if err != nil {
+		forwardError(w, r, err)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		switch {
+		case sw.err != nil:
+			release(errorOutcome(ctx, sw.err))
+		case sw.status == 0:
+			// Aborted while copying the response to the client
+			release(outcomeIgnored)
+		default:
+			release(statusOutcome(sw.status))
+		}
+	}()
+	w = sw
+
+	// Hop-by-hop headers are removed by the reverse proxy, the forwarding
+	// ones are set by the upstream rewrite
+	if rt.Headers != nil {
+		data := headerData{
+			ClientIP: clientIP(r),
+			Producer: producer,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Attempt:  1,
+		}
+
+		if err := rt.Headers.Apply(r.Header, data); err != nil {
+			forwardError(w, r, err)
+			return
+		}
+	}
+
+	if rt.Rewrite != nil {
+		rt.Rewrite.Apply(r.URL)
+	}
+
+	if timeout := u.client.Timeout; timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		r = r.WithContext(ctx)
+	}
+
+	u.forwarder.ServeHTTP(w, r)
+}
+
+// Reports whether the response status means the upstream is overloaded
+func overloaded(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+func statusOutcome(status int) outcome {
+	if overloaded(status) {
+		return outcomeCongested
+	}
+
+	return outcomeOK
+}
+
+// Timeouts and connection errors mean the upstream is congested.
+// The requests cancelled by the caller, e.g. on shutdown or disconnect,
+// and the ones which couldn't be sent, e.g. with invalid URL, don't.
+func errorOutcome(ctx context.Context, err error) outcome {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return outcomeIgnored
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return outcomeCongested
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return outcomeCongested
+	}
+
+	return outcomeIgnored
+}
+
+// Remembers the response status and the proxying error for the limits
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush the streamed responses
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Finds the route by name or the one matching the path and its upstream
+func (c *Client) match(path, name string) (*route.Route, *upstream) {
+	if c.router == nil {
+		return &route.Route{}, c.upstream
+	}
+
+	rt, ok := c.router.Get(name)
+	if !ok {
+		rt = c.router.Match(path)
+	}
+
+	if u, ok := c.upstreams[rt.Upstream]; ok {
+		return rt, u
+	}
+
+	return rt, c.upstream
+}
@@ -2,8 +2,15 @@ package worker
 
 import (
 	"context"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
 	"testing"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
 )
 
 type MockedRoundTripper struct {
@@ -33,12 +40,14 @@ func TestDo(t *testing.T) {
 	}
 
 	client := &Client{
-		client: &http.Client{
-			Transport: transport,
-		},
+		upstream: &upstream{
+			client: &http.Client{
+				Transport: transport,
+			},
 
-		remoteHost:   "remote",
-		remoteScheme: "http",
+			remoteHost:   "remote",
+			remoteScheme: "http",
+		},
 	}
 
 	// POST request successfully forwarded
@@ -65,3 +74,123 @@ func TestDo(t *testing.T) {
 		t.Errorf("expected to change request endpoint: %s != /endpoint", checkPath)
 	}
 }
+
+func TestForward(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.Header().Set("X-Upstream", r.URL.Path)
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer server.Close()
+
+	remoteURL, _ := url.Parse(server.URL)
+	u := &upstream{
+		client:       &http.Client{},
+		remoteHost:   remoteURL.Host,
+		remoteScheme: remoteURL.Scheme,
+	}
+	u.forwarder = &httputil.ReverseProxy{Rewrite: u.rewrite}
+	client := &Client{upstream: u}
+
+	r := httptest.NewRequest("GET", "http://proxy/ping", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	rec := httptest.NewRecorder()
+	client.Forward(rec, r, "")
+
+	// The same as the asynchronous deliveries get
+	expected := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+	addForwardedHeaders(expected, "192.0.2.1", "http")
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "Forwarded"} {
+		if forwarded.Get(name) != expected.Get(name) {
+			t.Errorf("expected %s header: %q != %q", name, forwarded.Get(name), expected.Get(name))
+		}
+	}
+
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("expected upstream status: %d != %d", rec.Code, http.StatusTeapot)
+	}
+	if rec.Header().Get("X-Upstream") != "/ping" {
+		t.Errorf("expected upstream headers: %s != /ping", rec.Header().Get("X-Upstream"))
+	}
+	if rec.Body.String() != "pong" {
+		t.Errorf("expected upstream body: %s != pong", rec.Body.String())
+	}
+}
+
+func TestForwardDisconnected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	limits, err := newUpstreamLimits("api", cfg.Limits{Adaptive: cfg.Adaptive{Enabled: true, Initial: 4}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remoteURL, _ := url.Parse(server.URL)
+	u := &upstream{
+		client:       &http.Client{},
+		remoteHost:   remoteURL.Host,
+		remoteScheme: remoteURL.Scheme,
+		limits:       limits,
+	}
+	u.forwarder = &httputil.ReverseProxy{Rewrite: u.rewrite, ErrorHandler: forwardError}
+	client := &Client{upstream: u}
+
+	// The client is gone before the request is forwarded
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec := httptest.NewRecorder()
+	client.Forward(rec, httptest.NewRequest("GET", "http://proxy/ping", nil).WithContext(ctx), "")
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected bad gateway, got %d", rec.Code)
+	}
+	if limits.adaptive.limit != 4 || limits.adaptive.inFlight != 0 {
+		t.Errorf("expected the disconnect not to decrease the limit, limit %.2f", limits.adaptive.limit)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var checkBody []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkBody, _ = ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	remote, _ := url.Parse(server.URL)
+	client := &Client{
+		upstream: &upstream{
+			client:       server.Client(),
+			remoteHost:   remote.Host,
+			remoteScheme: remote.Scheme,
+		},
+	}
+
+	r := &Request{
+		Header:    http.Header{},
+		Method:    "POST",
+		OriginURL: "/endpoint",
+	}
+
+	body := ioutil.NopCloser(strings.NewReader("streamed"))
+	if err := client.Stream(context.Background(), r, body, -1); err != nil {
+		t.Fatalf("request should complete without errors: %s", err)
+	}
+	if string(checkBody) != "streamed" {
+		t.Errorf("expected the streamed body: %q", checkBody)
+	}
+
+	r.OriginURL = "/fail"
+	body = ioutil.NopCloser(strings.NewReader("streamed"))
+	if err := client.Stream(context.Background(), r, body, 8); err == nil {
+		t.Error("expected upstream error")
+	}
+}
@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers are meaningful only for a single connection
+// See: https://www.rfc-editor.org/rfc/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Variables available in the header templates
+type headerData struct {
+	RequestID string
+	ClientIP  string
+	Producer  string
+	Method    string
+	Path      string
+	Attempt   int
+}
+
+// Removes hop-by-hop headers and the ones computed by the client
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+
+	h.Del("Content-Length")
+}
+
+// Sets X-Forwarded-For, X-Forwarded-Proto and Forwarded headers
+func addForwardedHeaders(h http.Header, clientIP, proto string) {
+	if clientIP == "" {
+		return
+	}
+
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+	} else {
+		h.Set("X-Forwarded-For", clientIP)
+	}
+
+	forwarded := "for=" + forwardedNode(clientIP)
+	if proto != "" {
+		h.Set("X-Forwarded-Proto", proto)
+		forwarded += ";proto=" + proto
+	}
+
+	h.Add("Forwarded", forwarded)
+}
+
+// IPv6 addresses must be quoted and enclosed in brackets
+// See: https://www.rfc-editor.org/rfc/rfc7239#section-6
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func proto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+var (
+	upstreamInFlightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_requests_in_flight",
+		Help: "Number of requests being sent to the upstream.",
+	}, []string{"upstream"})
+
+	upstreamThrottledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_throttled_total",
+		Help: "Number of requests waiting for the upstream limits.",
+	}, []string{"upstream"})
+)
+
+// Outbound rate and concurrency limits of the upstream
+type upstreamLimits struct {
+	name    string
+	limiter *rate.Limiter
+
+	// Slots of the requests in flight, nil if unlimited or adaptive
+	slots chan struct{}
+
+	// Adaptive concurrency limit, nil if disabled
+	adaptive *adaptiveLimit
+}
+
+// Outcome of the request adjusting the adaptive limit
+type outcome int
+
+const (
+	outcomeOK outcome = iota
+
+	// Timeouts, connection errors, 5xx and 429 responses
+	outcomeCongested
+
+	// Not the upstream's doing, e.g. cancelled or invalid requests,
+	// the slot is freed without adjusting the limit
+	outcomeIgnored
+)
+
+// Signature of the function to free the slot of the request when it's done
+type releaseFunc func(outcome)
+
+// Returns nil if the upstream has no limits. The adaptive limit grows
+// up to max_concurrency or maxClients if it's not set.
+func newUpstreamLimits(name string, config cfg.Limits, maxClients int) (*upstreamLimits, error) {
+	if config.Rate < 0 || config.Burst < 0 || config.MaxConcurrency < 0 {
+		return nil, fmt.Errorf("upstream %s: limits must be >= 0", name)
+	}
+
+	if config.Rate == 0 && config.MaxConcurrency == 0 && !config.Adaptive.Enabled {
+		return nil, nil
+	}
+
+	l := &upstreamLimits{name: name}
+
+	if config.Rate > 0 {
+		burst := config.Burst
+		if burst == 0 {
+			burst = config.Rate
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(config.Rate), burst)
+	}
+
+	if config.Adaptive.Enabled {
+		max := config.MaxConcurrency
+		if max == 0 {
+			max = maxClients
+		}
+
+		var err error
+		if l.adaptive, err = newAdaptiveLimit(name, config.Adaptive, max); err != nil {
+			return nil, err
+		}
+	} else if config.MaxConcurrency > 0 {
+		l.slots = make(chan struct{}, config.MaxConcurrency)
+	}
+
+	return l, nil
+}
+
+// Waits for the free slot and the rate, returns the func to free the slot
+func (l *upstreamLimits) acquire(ctx context.Context) (releaseFunc, error) {
+	if l == nil {
+		return func(outcome) {}, nil
+	}
+
+	if l.saturated() {
+		upstreamThrottledCounter.WithLabelValues(l.name).Inc()
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var inFlight int
+	if l.adaptive != nil {
+		var err error
+		if inFlight, err = l.adaptive.acquire(ctx); err != nil {
+			if l.slots != nil {
+				<-l.slots
+			}
+			return nil, err
+		}
+	}
+
+	if l.limiter != nil {
+		if err := l.limiter.Wait(ctx); err != nil {
+			if l.slots != nil {
+				<-l.slots
+			}
+			if l.adaptive != nil {
+				l.adaptive.cancel()
+			}
+			return nil, err
+		}
+	}
+
+	upstreamInFlightGauge.WithLabelValues(l.name).Inc()
+	start := time.Now()
+
+	return func(o outcome) {
+		if l.slots != nil {
+			<-l.slots
+		}
+		if l.adaptive != nil {
+			if o == outcomeIgnored {
+				l.adaptive.cancel()
+			} else {
+				l.adaptive.release(start, inFlight, o == outcomeCongested)
+			}
+		}
+		upstreamInFlightGauge.WithLabelValues(l.name).Dec()
+	}, nil
+}
+
+// Reports whether the request would have to wait
+func (l *upstreamLimits) saturated() bool {
+	if l == nil {
+		return false
+	}
+
+	if l.slots != nil && len(l.slots) == cap(l.slots) {
+		return true
+	}
+
+	if l.adaptive != nil && l.adaptive.saturated() {
+		return true
+	}
+
+	if l.limiter != nil {
+		// The reservation is given back only if cancelled at its time
+		now := time.Now()
+		r := l.limiter.ReserveN(now, 1)
+		defer r.CancelAt(now)
+
+		return r.DelayFrom(now) > 0
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+func TestUpstreamLimits(t *testing.T) {
+	if l, err := newUpstreamLimits("api", cfg.Limits{}, 10); l != nil || err != nil {
+		t.Errorf("expected no limits: %v", err)
+	}
+
+	if _, err := newUpstreamLimits("api", cfg.Limits{Rate: -1}, 10); err == nil {
+		t.Error("expected error for negative rate")
+	}
+
+	l, err := newUpstreamLimits("api", cfg.Limits{Rate: 1000, Burst: 10, MaxConcurrency: 2}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	release1, err := l.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !l.saturated() {
+		t.Error("expected upstream to be saturated by concurrency")
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = l.acquire(timeout); err == nil {
+		t.Error("expected to wait for a free slot")
+	}
+
+	release1(outcomeOK)
+	if l.saturated() {
+		t.Error("expected upstream to have a free slot")
+	}
+}
+
+func TestUpstreamLimitsOutcome(t *testing.T) {
+	l, err := newUpstreamLimits("api", cfg.Limits{Adaptive: cfg.Adaptive{Enabled: true, Initial: 4}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(outcomeIgnored)
+	if l.adaptive.limit != 4 || l.adaptive.inFlight != 0 {
+		t.Errorf("expected the ignored request to free the slot only, limit %.2f", l.adaptive.limit)
+	}
+
+	release, _ = l.acquire(ctx)
+	release(outcomeCongested)
+	if l.adaptive.limit >= 4 {
+		t.Errorf("expected the congested request to decrease the limit, limit %.2f", l.adaptive.limit)
+	}
+}
+
+func TestErrorOutcome(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx  context.Context
+		err  error
+		want outcome
+	}{
+		{context.Background(), &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, outcomeCongested},
+		{context.Background(), &url.Error{Op: "Post", Err: context.DeadlineExceeded}, outcomeCongested},
+		{context.Background(), &url.Error{Op: "Post", Err: io.EOF}, outcomeCongested},
+		{context.Background(), &url.Error{Op: "Post", Err: errors.New("unsupported protocol scheme")}, outcomeIgnored},
+		{context.Background(), &url.Error{Op: "Post", Err: context.Canceled}, outcomeIgnored},
+		{cancelled, &url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, outcomeIgnored},
+	}
+
+	for _, tt := range tests {
+		if got := errorOutcome(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%v: expected outcome %d, got %d", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestUpstreamLimitsRate(t *testing.T) {
+	l, err := newUpstreamLimits("api", cfg.Limits{Rate: 1}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.saturated() {
+		t.Error("expected upstream to have the rate")
+	}
+
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(outcomeOK)
+
+	if !l.saturated() {
+		t.Error("expected upstream to be saturated by rate")
+	}
+}
+
+func TestClientSaturated(t *testing.T) {
+	limited, _ := newUpstreamLimits("limited", cfg.Limits{MaxConcurrency: 1}, 10)
+	client := &Client{
+		upstream: &upstream{name: "default"},
+		upstreams: map[string]*upstream{
+			"limited": {name: "limited", limits: limited},
+		},
+	}
+
+	if saturated := client.Saturated(); len(saturated) != 0 {
+		t.Errorf("expected no saturated upstreams: %v", saturated)
+	}
+
+	if _, err := limited.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if saturated := client.Saturated(); !reflect.DeepEqual(saturated, []string{"limited"}) {
+		t.Errorf("expected limited upstream to be saturated: %v", saturated)
+	}
+}
+
+func TestSelectConds(t *testing.T) {
+	var conds selectConds
+	if conds.where() != "" {
+		t.Errorf("expected no conditions: %s", conds.where())
+	}
+
+	skip := conds.with(skipDestinationsCond, "{api}")
+	tenant := skip.with(tenantCond, "acme")
+
+	if where := skip.where(); where != "WHERE destination <> ALL($1::varchar[])" {
+		t.Errorf("unexpected conditions: %s", where)
+	}
+	if where := tenant.where(); where != "WHERE destination <> ALL($1::varchar[]) AND tenant = $2" {
+		t.Errorf("unexpected conditions: %s", where)
+	}
+	if len(tenant.args) != 2 || len(skip.args) != 1 {
+		t.Errorf("unexpected arguments: %v %v", skip.args, tenant.args)
+	}
+}
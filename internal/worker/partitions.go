@@ -0,0 +1,380 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+const (
+	isPartitionedSQL = `
+    SELECT EXISTS (
+      SELECT 1 FROM pg_partitioned_table
+      WHERE partrelid = 'proxy_requests'::regclass
+    );
+  `
+
+	listPartitionsSQL = `
+    SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+    FROM pg_inherits i
+    JOIN pg_class c ON c.oid = i.inhrelid
+    WHERE i.inhparent = 'proxy_requests'::regclass;
+  `
+
+	// Partitions are created and checked for the time of the database
+	// as the requests get it from now()
+	localTimestampSQL = `SELECT localtimestamp;`
+
+	createPartitionSQL = `
+    CREATE TABLE IF NOT EXISTS %s PARTITION OF proxy_requests
+    FOR VALUES FROM ('%s') TO ('%s');
+  `
+
+	partitionLockSQL = `
+    SET LOCAL lock_timeout = '1s';
+    LOCK TABLE %s IN ACCESS EXCLUSIVE MODE;
+  `
+
+	partitionEmptySQL = `SELECT NOT EXISTS (SELECT 1 FROM %s);`
+
+	dropPartitionSQL = `DROP TABLE %s;`
+
+	defaultPartitionInterval = time.Hour
+	defaultPartitionPremake  = 3
+
+	// How often the partitions are created and dropped
+	partitionCheckInterval = time.Minute
+
+	partitionBoundLayout = "2006-01-02 15:04:05.999999"
+	partitionNameLayout  = "20060102_150405"
+)
+
+var (
+	partitionBoundRe = regexp.MustCompile(`^FOR VALUES FROM \((.+)\) TO \((.+)\)$`)
+
+	// Upper bound of the MAXVALUE partitions
+	partitionMaxTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+)
+
+// Partition of proxy_requests with its range of timestamps
+type partition struct {
+	name      string
+	from, to  time.Time
+	isDefault bool
+}
+
+// Creates the upcoming partitions of proxy_requests and drops
+// the past ones once they are empty
+type partitionManager struct {
+	db       *sql.DB
+	interval time.Duration
+	premake  int
+
+	// Partitions to dequeue from: the default one first, then the oldest
+	mu     sync.RWMutex
+	tables []string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newPartitionManager(db *sql.DB, config cfg.Partitioning) (*partitionManager, error) {
+	m := &partitionManager{
+		db:       db,
+		interval: config.Interval,
+		premake:  config.Premake,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if m.interval == 0 {
+		m.interval = defaultPartitionInterval
+	}
+	if m.interval < time.Minute {
+		return nil, fmt.Errorf("partition interval must be >= 1m: %s", m.interval)
+	}
+
+	if m.premake == 0 {
+		m.premake = defaultPartitionPremake
+	}
+	if m.premake < 0 {
+		return nil, fmt.Errorf("number of premade partitions must be >= 0: %d", m.premake)
+	}
+
+	var partitioned bool
+	if err := db.QueryRow(isPartitionedSQL).Scan(&partitioned); err != nil {
+		return nil, err
+	}
+	if !partitioned {
+		return nil, errors.New("proxy_requests is not partitioned, apply the partitioning migrations")
+	}
+
+	if err := m.maintain(context.Background()); err != nil {
+		return nil, err
+	}
+
+	go m.run()
+
+	return m, nil
+}
+
+func (m *partitionManager) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(partitionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.maintain(context.Background()); err != nil {
+				log.WithError(err).Error("partitions error")
+			}
+		}
+	}
+}
+
+func (m *partitionManager) Shutdown() {
+	close(m.stop)
+	<-m.done
+}
+
+// Tables returns the partitions in the dequeue order
+func (m *partitionManager) Tables() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.tables
+}
+
+// Creates the current and the upcoming partitions, drops the empty past ones
+func (m *partitionManager) maintain(ctx context.Context) error {
+	var now time.Time
+	if err := m.db.QueryRowContext(ctx, localTimestampSQL).Scan(&now); err != nil {
+		return err
+	}
+
+	parts, err := m.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := now.Truncate(m.interval)
+	for i := 0; i <= m.premake; i++ {
+		from := current.Add(time.Duration(i) * m.interval)
+		if err = m.create(ctx, parts, from, from.Add(m.interval)); err != nil {
+			// The default partition has the requests of the range
+			log.WithField("from", from).WithError(err).Warn("couldn't create partition")
+		}
+	}
+
+	if parts, err = m.list(ctx); err != nil {
+		return err
+	}
+
+	var past, rest []partition
+	for _, p := range parts {
+		if !p.isDefault && !p.to.After(now) {
+			past = append(past, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+
+	// Stop dequeueing from the partitions before dropping them
+	m.setTables(rest)
+
+	for _, p := range past {
+		if err = m.drop(ctx, p.name); err != nil {
+			log.WithField("partition", p.name).WithError(err).Warn("couldn't drop partition")
+		}
+	}
+
+	if parts, err = m.list(ctx); err != nil {
+		return err
+	}
+	m.setTables(parts)
+
+	return nil
+}
+
+func (m *partitionManager) list(ctx context.Context) ([]partition, error) {
+	rows, err := m.db.QueryContext(ctx, listPartitionsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []partition
+	for rows.Next() {
+		var name, bound string
+		if err = rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+
+		p, err := parsePartitionBound(bound)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %v", name, err)
+		}
+		p.name = name
+
+		parts = append(parts, p)
+	}
+
+	return parts, rows.Err()
+}
+
+func (m *partitionManager) setTables(parts []partition) {
+	sort.Slice(parts, func(i, j int) bool {
+		if parts[i].isDefault != parts[j].isDefault {
+			return parts[i].isDefault
+		}
+		return parts[i].from.Before(parts[j].from)
+	})
+
+	tables := make([]string, len(parts))
+	for i, p := range parts {
+		tables[i] = pq.QuoteIdentifier(p.name)
+	}
+
+	m.mu.Lock()
+	m.tables = tables
+	m.mu.Unlock()
+}
+
+// Creates the partition for the part of the range not covered yet
+func (m *partitionManager) create(ctx context.Context, parts []partition, from, to time.Time) error {
+	from, to, ok := uncoveredRange(parts, from, to)
+	if !ok {
+		return nil
+	}
+
+	name := "proxy_requests_" + from.Format(partitionNameLayout)
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf(
+		createPartitionSQL, pq.QuoteIdentifier(name),
+		from.Format(partitionBoundLayout), to.Format(partitionBoundLayout),
+	))
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"partition": name,
+		"from":      from,
+		"to":        to,
+	}).Info("Created partition")
+
+	return nil
+}
+
+// Drops the partition if it's empty
+func (m *partitionManager) drop(ctx context.Context, name string) error {
+	table := pq.QuoteIdentifier(name)
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Waits for the dequeues from the partition in progress
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(partitionLockSQL, table)); err != nil {
+		return err
+	}
+
+	var empty bool
+	if err = tx.QueryRowContext(ctx, fmt.Sprintf(partitionEmptySQL, table)).Scan(&empty); err != nil {
+		return err
+	}
+	if !empty {
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(dropPartitionSQL, table)); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit error: %v", err)
+	}
+
+	log.WithField("partition", name).Info("Dropped partition")
+
+	return nil
+}
+
+// Narrows the range to the part not covered by the partitions.
+// Reports false if nothing is left.
+func uncoveredRange(parts []partition, from, to time.Time) (time.Time, time.Time, bool) {
+	sorted := make([]partition, 0, len(parts))
+	for _, p := range parts {
+		if !p.isDefault {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].from.Before(sorted[j].from) })
+
+	for _, p := range sorted {
+		if !p.from.After(from) && p.to.After(from) {
+			from = p.to
+		}
+	}
+
+	for _, p := range sorted {
+		if p.from.After(from) && p.from.Before(to) {
+			to = p.from
+			break
+		}
+	}
+
+	return from, to, from.Before(to)
+}
+
+// Parses the partition bound expression, e.g.
+// FOR VALUES FROM ('2026-10-18 10:00:00') TO ('2026-10-18 11:00:00')
+func parsePartitionBound(bound string) (partition, error) {
+	if bound == "DEFAULT" {
+		return partition{isDefault: true}, nil
+	}
+
+	match := partitionBoundRe.FindStringSubmatch(bound)
+	if match == nil {
+		return partition{}, fmt.Errorf("unexpected bound: %s", bound)
+	}
+
+	from, err := parseBoundValue(match[1])
+	if err != nil {
+		return partition{}, err
+	}
+
+	to, err := parseBoundValue(match[2])
+	if err != nil {
+		return partition{}, err
+	}
+
+	return partition{from: from, to: to}, nil
+}
+
+func parseBoundValue(value string) (time.Time, error) {
+	switch value {
+	case "MINVALUE":
+		return time.Time{}, nil
+	case "MAXVALUE":
+		return partitionMaxTime, nil
+	}
+
+	return time.Parse(partitionBoundLayout, strings.Trim(value, "'"))
+}
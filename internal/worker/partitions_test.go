@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pressly/goose"
+)
+
+func TestParsePartitionBound(t *testing.T) {
+	p, err := parsePartitionBound("FOR VALUES FROM ('2026-10-18 10:00:00') TO ('2026-10-18 11:00:00')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.from != time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC) || p.to != time.Date(2026, 10, 18, 11, 0, 0, 0, time.UTC) {
+		t.Errorf("unexpected range: %s - %s", p.from, p.to)
+	}
+
+	p, err = parsePartitionBound("FOR VALUES FROM (MINVALUE) TO ('2026-10-18 10:23:45.123456')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.from.IsZero() || p.to.Nanosecond() != 123456000 {
+		t.Errorf("unexpected range: %s - %s", p.from, p.to)
+	}
+
+	if p, err = parsePartitionBound("DEFAULT"); err != nil || !p.isDefault {
+		t.Errorf("expected default partition: %v", err)
+	}
+
+	if _, err = parsePartitionBound("FOR VALUES IN (1)"); err == nil {
+		t.Error("expected error for list partition")
+	}
+}
+
+func TestUncoveredRange(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2026, 10, 18, hour, min, 0, 0, time.UTC)
+	}
+
+	parts := []partition{
+		{isDefault: true},
+		{from: time.Time{}, to: at(10, 20)},
+		{from: at(11, 0), to: at(12, 0)},
+		{from: at(13, 30), to: at(14, 0)},
+	}
+
+	tests := []struct {
+		from, to time.Time
+		wantFrom time.Time
+		wantTo   time.Time
+		ok       bool
+	}{
+		{at(10, 0), at(11, 0), at(10, 20), at(11, 0), true},
+		{at(11, 0), at(12, 0), time.Time{}, time.Time{}, false},
+		{at(13, 0), at(14, 0), at(13, 0), at(13, 30), true},
+		{at(14, 0), at(15, 0), at(14, 0), at(15, 0), true},
+	}
+
+	for _, tt := range tests {
+		from, to, ok := uncoveredRange(parts, tt.from, tt.to)
+		if ok != tt.ok || ok && (from != tt.wantFrom || to != tt.wantTo) {
+			t.Errorf("%s - %s: got %s - %s %v", tt.from, tt.to, from, to, ok)
+		}
+	}
+}
+
+func TestPgQueuePartitions(t *testing.T) {
+	config := testDBConfig(t)
+	config.Db.Partitioning.Enabled = true
+
+	db, err := sql.Open("postgres", config.Db.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The legacy row stays in the oldest partition
+	_, err = db.Exec(`
+    INSERT INTO proxy_requests (timestamp, id, method, header, body, origin_url, attempt)
+    VALUES (now() - interval '1 day', 'old', 'POST', '{}', 'old', '/hooks', 1);
+  `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexes := tableIndexes(t, db, "proxy_requests")
+
+	goose.SetTableName("goose_partitioning_version")
+	defer goose.SetTableName("goose_db_version")
+
+	if err = goose.Up(db, "../../migrations/partitioning"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := goose.Down(db, "../../migrations/partitioning"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	if err = queue.ManagePartitions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Legacy, default and the current with the upcoming ones
+	if tables := queue.partitions.Tables(); len(tables) != defaultPartitionPremake+3 {
+		t.Errorf("expected partitions to be created: %v", tables)
+	}
+
+	// The new partitions get all the indexes of the table
+	tables := queue.partitions.Tables()
+	newest := tableIndexes(t, db, tables[len(tables)-1])
+	for index := range indexes {
+		if !newest[index] {
+			t.Errorf("expected the new partition to have index %s: %v", index, newest)
+		}
+	}
+
+	if err = queue.EnqueueRequest(&Request{ID: "new", Method: "POST", OriginURL: "/hooks"}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"old", "new"} {
+		r, _, err := queue.DequeueRequest(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != id {
+			t.Errorf("expected %s request, got %s", id, r.ID)
+		}
+	}
+
+	// The empty legacy partition is dropped
+	if err = queue.partitions.maintain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tables := queue.partitions.Tables(); len(tables) != defaultPartitionPremake+2 {
+		t.Errorf("expected legacy partition to be dropped: %v", tables)
+	}
+}
+
+// Returns the definitions of the table indexes without their names
+// and the primary key, which differs for the partitioned table
+func tableIndexes(t *testing.T, db *sql.DB, table string) map[string]bool {
+	t.Helper()
+
+	rows, err := db.Query(`
+    SELECT regexp_replace(pg_get_indexdef(indexrelid), '^.* USING ', '')
+    FROM pg_index
+    WHERE indrelid = $1::regclass AND NOT indisprimary;
+  `, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	indexes := map[string]bool{}
+	for rows.Next() {
+		var index string
+		if err = rows.Scan(&index); err != nil {
+			t.Fatal(err)
+		}
+		indexes[index] = true
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return indexes
+}
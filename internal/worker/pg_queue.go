@@ -8,28 +8,40 @@ package worker
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 
 	cfg "github.com/evilmartians/asyncproxy/config"
-
-	_ "github.com/lib/pq"
+	"github.com/evilmartians/asyncproxy/internal/blob"
+	"github.com/evilmartians/asyncproxy/internal/codec"
 )
 
 const (
 	insertSQL = `
     INSERT INTO proxy_requests (
-      timestamp, id, method, header, body, origin_url, attempt
-    ) VALUES (now(), $1, $2, $3, $4, $5, $6);
+      timestamp, id, method, header_data, body_data, origin_url, attempt, meta,
+      header_format, body_format, key_id, data_key, body_ref, tenant, destination, created_at
+    ) VALUES (
+      now() + make_interval(secs => $15), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+      COALESCE($16::timestamp, LOCALTIMESTAMP)
+    );
   `
 
 	selectWithIndexSQL = `
-    SELECT id, method, header, body, origin_url, attempt
-    FROM proxy_requests
+    SELECT id, method, origin_url, attempt, meta, tenant, COALESCE(created_at, timestamp),
+      header, body, header_data, body_data,
+      header_format, body_format, key_id, data_key, body_ref
+    FROM %s %s
     ORDER BY date_trunc('minute', timestamp) ASC
     LIMIT 1
     FOR UPDATE
@@ -37,35 +49,129 @@ const (
   `
 
 	selectWithoutIndexSQL = `
-    SELECT id, method, header, body, origin_url, attempt
-    FROM proxy_requests
+    SELECT id, method, origin_url, attempt, meta, tenant, COALESCE(created_at, timestamp),
+      header, body, header_data, body_data,
+      header_format, body_format, key_id, data_key, body_ref
+    FROM %s %s
     LIMIT 1
     FOR UPDATE
     SKIP LOCKED;
   `
 
 	deleteSQL = `
-    DELETE FROM proxy_requests WHERE id = $1;
+    DELETE FROM %s WHERE id = $1;
+  `
+
+	// Updated through the parent table to move the row between partitions
+	postponeSQL = `
+    UPDATE proxy_requests SET timestamp = now() + make_interval(secs => $2) WHERE id = $1;
   `
 
 	countTotalSQL = `
     SELECT COUNT(*) FROM proxy_requests;
+  `
+
+	// The expression of the index, the rows enqueued before created_at
+	// was introduced have only the timestamp
+	oldestAgeSQL = `
+    SELECT COALESCE(EXTRACT(EPOCH FROM LOCALTIMESTAMP - min(COALESCE(created_at, timestamp))), 0)
+    FROM proxy_requests;
+  `
+
+	countTenantsSQL = `
+    SELECT tenant, COUNT(*) FROM proxy_requests GROUP BY tenant;
+  `
+
+	// Conditions of the select queries, %d is the argument number
+	readyCond            = `timestamp <= now()`
+	tenantCond           = `tenant = $%d`
+	otherTenantsCond     = `tenant <> ALL($%d::varchar[])`
+	skipDestinationsCond = `destination <> ALL($%d::varchar[])`
+
+	selectNotReencryptedSQL = `
+    SELECT id,
+      header, body, header_data, body_data,
+      header_format, body_format, key_id, data_key, body_ref
+    FROM proxy_requests
+    WHERE key_id IS DISTINCT FROM $1
+    LIMIT $2
+    FOR UPDATE
+    SKIP LOCKED;
+  `
+
+	updatePayloadSQL = `
+    UPDATE proxy_requests
+    SET header = NULL, body = NULL, header_data = $2, body_data = $3,
+      header_format = $4, body_format = $5, key_id = $6, data_key = $7,
+      body_ref = $8
+    WHERE id = $1;
   `
 )
 
+// Rows failing to load are postponed so they don't block the queue
+const payloadErrorDelay = 5 * time.Minute
+
+var payloadErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "queue_payload_errors_total",
+	Help: "Number of dequeued requests postponed because their payload couldn't be loaded.",
+}, []string{"reason"})
+
 var (
 	EmptyQueueError        = errors.New("queue is empty")
 	querySQL        string = selectWithIndexSQL
+
+	// Table to dequeue from if it's not partitioned
+	queueTables = []string{"proxy_requests"}
 )
 
 type PgQueue struct {
 	db *sql.DB
+
+	// Compresses and encrypts the stored payloads
+	codec *codec.Codec
+
+	// Keeps the bodies of blobMinSize and larger, nil if not configured
+	blobs       blob.Store
+	blobMinSize int
+	blobConfig  cfg.Blob
+
+	// Deletes the orphaned blobs, nil if there is no blob store
+	// or the queue isn't the one of the workers
+	blobGC *blobCollector
+
+	// Manages the partitions of the table, nil if it's not partitioned
+	// or the queue isn't the one of the workers
+	partitions   *partitionManager
+	partitioning cfg.Partitioning
+
+	// Takes turns between the tenants, nil if there are no tenants
+	tenants *tenantScheduler
+}
+
+// Error of the locked row whose payload couldn't be loaded
+type payloadError struct {
+	id     string
+	reason string
+	err    error
+}
+
+func (e *payloadError) Error() string {
+	return fmt.Sprintf("request %s: %s error: %v", e.id, e.reason, e.err)
+}
+
+func (e *payloadError) Unwrap() error {
+	return e.err
 }
 
 type record struct {
 	request *Request
 	id      string
 	attempt int
+
+	// Table or partition the record is in
+	table string
+
+	tenant string
 }
 
 func NewPgQueue(config *cfg.Config) (*PgQueue, error) {
@@ -76,15 +182,36 @@ func NewPgQueue(config *cfg.Config) (*PgQueue, error) {
 
 	db.SetMaxOpenConns(config.Db.MaxConnections)
 
+	payloadCodec, err := codec.New(config.Queue.Compression, config.Queue.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
 	if config.Db.UseIndex {
 		querySQL = selectWithIndexSQL
 	} else {
 		querySQL = selectWithoutIndexSQL
 	}
 
+	blobs, err := blob.New(config.Queue.Blob)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := newTenantScheduler(config.Tenants)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, _ := payloadCodec.Encrypted()
+
 	log.WithFields(log.Fields{
 		"max_connection": config.Db.MaxConnections,
 		"using_index":    config.Db.UseIndex,
+		"compress_from":  config.Queue.Compression.MinSize,
+		"encryption_key": keyID,
+		"blob_store":     config.Queue.Blob.Type,
+		"partitioned":    config.Db.Partitioning.Enabled,
 	}).Info("Initializing postgresql")
 
 	err = db.Ping()
@@ -92,17 +219,94 @@ func NewPgQueue(config *cfg.Config) (*PgQueue, error) {
 		return nil, err
 	}
 
-	queue := &PgQueue{db: db}
+	queue := &PgQueue{
+		db:           db,
+		codec:        payloadCodec,
+		blobs:        blobs,
+		blobMinSize:  config.Queue.Blob.MinSize,
+		blobConfig:   config.Queue.Blob,
+		tenants:      tenants,
+		partitioning: config.Db.Partitioning,
+	}
 
 	return queue, nil
 }
 
+// ManagePartitions starts creating and dropping the partitions if
+// the partitioning is enabled. Only the queue of the workers does it,
+// so the other instances in the process don't race with it.
+func (q *PgQueue) ManagePartitions() error {
+	if !q.partitioning.Enabled {
+		return nil
+	}
+
+	var err error
+	q.partitions, err = newPartitionManager(q.db, q.partitioning)
+
+	return err
+}
+
+// CollectBlobs starts deleting the orphaned blobs if the blob store
+// is configured. Only the queue of the workers does it.
+func (q *PgQueue) CollectBlobs() error {
+	if q.blobs == nil {
+		return nil
+	}
+
+	var err error
+	q.blobGC, err = newBlobCollector(q.db, q.blobs, q.blobConfig)
+
+	return err
+}
+
 func (q *PgQueue) Total() (cnt uint64) {
 	_ = q.db.QueryRow(countTotalSQL).Scan(&cnt)
 	return
 }
 
+// OldestAge returns the age of the oldest request in the queue since
+// it was enqueued the first time, 0 if the queue is empty
+func (q *PgQueue) OldestAge() (time.Duration, error) {
+	var seconds float64
+	if err := q.db.QueryRow(oldestAgeSQL).Scan(&seconds); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// TenantTotals returns the number of requests in the queue by tenant
+func (q *PgQueue) TenantTotals() (map[string]uint64, error) {
+	rows, err := q.db.Query(countTenantsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]uint64{}
+	for rows.Next() {
+		var (
+			tenant string
+			cnt    uint64
+		)
+		if err = rows.Scan(&tenant, &cnt); err != nil {
+			return nil, err
+		}
+		totals[tenant] = cnt
+	}
+
+	return totals, rows.Err()
+}
+
 func (q *PgQueue) Shutdown() error {
+	if q.partitions != nil {
+		q.partitions.Shutdown()
+	}
+
+	if q.blobGC != nil {
+		q.blobGC.Shutdown()
+	}
+
 	q.db.Close()
 
 	return nil
@@ -110,31 +314,130 @@ func (q *PgQueue) Shutdown() error {
 
 // Put request into the database
 func (q *PgQueue) EnqueueRequest(r *Request, attempt int) error {
+	return q.DeferRequest(r, attempt, 0)
+}
+
+// DeferRequest puts the request into the database to be dequeued
+// after the delay
+func (q *PgQueue) DeferRequest(r *Request, attempt int, delay time.Duration) error {
 	headers, err := json.Marshal(r.Header)
 	if err != nil {
 		return err
 	}
 
+	meta, err := json.Marshal(r.Meta)
+	if err != nil {
+		return err
+	}
+
+	id := r.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	payload, err := q.codec.Encode(id, headers, r.Body)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	bodyRef, err := q.putBlob(ctx, len(r.Body), payload)
+	if err != nil {
+		return err
+	}
+
 	_, err = q.db.Exec(
-		insertSQL, uuid.New(), r.Method, headers, r.Body, r.OriginURL, attempt,
+		insertSQL, id, r.Method, payload.Header, payload.Body, r.OriginURL, attempt, meta,
+		payload.HeaderFormat, payload.BodyFormat, nullString(payload.KeyID), payload.DataKey,
+		nullString(bodyRef), r.Meta[MetaTenant], r.Meta[MetaDestination], delay.Seconds(),
+		sql.NullTime{Time: r.createdAt, Valid: !r.createdAt.IsZero()},
 	)
 	if err != nil {
+		q.deleteBlob(ctx, bodyRef)
 		return err
 	}
 
+	// The retried request has a new blob now
+	q.deleteBlob(ctx, r.bodyRef)
+	r.bodyRef = bodyRef
+
+	return nil
+}
+
+// Complete removes the blob of the request delivered or dropped
+func (q *PgQueue) Complete(ctx context.Context, r *Request) {
+	q.deleteBlob(ctx, r.bodyRef)
+	r.bodyRef = ""
+}
+
+// Moves the body of the size to the blob store if it's large enough.
+// Returns the blob key, empty if the body is kept in the row.
+func (q *PgQueue) putBlob(ctx context.Context, size int, payload *codec.Payload) (string, error) {
+	if q.blobs == nil || size < q.blobMinSize {
+		return "", nil
+	}
+
+	ref := uuid.New().String()
+	if err := q.blobs.Put(ctx, ref, payload.Body); err != nil {
+		return "", fmt.Errorf("blob error: %v", err)
+	}
+
+	payload.Body = nil
+
+	return ref, nil
+}
+
+func (q *PgQueue) deleteBlob(ctx context.Context, ref string) {
+	if q.blobs == nil || ref == "" {
+		return
+	}
+
+	if err := q.blobs.Delete(ctx, ref); err != nil {
+		log.WithField("blob", ref).WithError(err).Warn("couldn't delete blob")
+	}
+}
+
+// Reads the body of the row from the blob store if it was moved there
+func (q *PgQueue) loadBlob(ctx context.Context, columns *payloadColumns, payload *codec.Payload) error {
+	if !columns.bodyRef.Valid {
+		return nil
+	}
+
+	if q.blobs == nil {
+		return fmt.Errorf("body is in blob %s, but blob store is not configured", columns.bodyRef.String)
+	}
+
+	body, err := q.blobs.Get(ctx, columns.bodyRef.String)
+	if err != nil {
+		return err
+	}
+	payload.Body = body
+
 	return nil
 }
 
 // Get request fron the database
-func (q *PgQueue) DequeueRequest(ctx context.Context) (*Request, int, error) {
+func (q *PgQueue) DequeueRequest(ctx context.Context, skip []string) (*Request, int, error) {
 	tx, err := q.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer tx.Rollback()
 
-	// Get the record
-	record, err := q.selectOne(ctx, tx)
+	// Get the record, the deferred ones are enqueued in the future
+	conds := selectConds{}.and(readyCond)
+	if len(skip) > 0 {
+		conds = conds.with(skipDestinationsCond, pq.Array(skip))
+	}
+
+	record, err := q.selectFair(ctx, tx, conds)
+
+	var payloadErr *payloadError
+	if errors.As(err, &payloadErr) {
+		return nil, 0, q.postpone(ctx, tx, payloadErr)
+	}
+
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return nil, 0, fmt.Errorf("rollback error: %v: %v", rollbackErr, err)
@@ -144,7 +447,7 @@ func (q *PgQueue) DequeueRequest(ctx context.Context) (*Request, int, error) {
 	}
 
 	// Delete the record
-	_, err = tx.ExecContext(ctx, deleteSQL, record.id)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(deleteSQL, record.table), record.id)
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return nil, 0, fmt.Errorf("rollback error: %v: %v", rollbackErr, err)
@@ -160,25 +463,105 @@ func (q *PgQueue) DequeueRequest(ctx context.Context) (*Request, int, error) {
 	return record.request, record.attempt, nil
 }
 
-func (q *PgQueue) selectOne(ctx context.Context, tx *sql.Tx) (record, error) {
+// Moves the row back in the queue, so the next ones are dequeued
+// while the blob store or the encryption keys are fixed
+func (q *PgQueue) postpone(ctx context.Context, tx *sql.Tx, payloadErr *payloadError) error {
+	payloadErrorsCounter.WithLabelValues(payloadErr.reason).Inc()
+
+	log.WithFields(log.Fields{
+		"id":    payloadErr.id,
+		"delay": payloadErrorDelay,
+	}).WithError(payloadErr.err).Warn("couldn't load request, postponing")
+
+	if _, err := tx.ExecContext(ctx, postponeSQL, payloadErr.id, payloadErrorDelay.Seconds()); err != nil {
+		return fmt.Errorf("%v: postpone error: %v", payloadErr, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%v: commit error: %v", payloadErr, err)
+	}
+
+	return payloadErr
+}
+
+// Selects the record of the tenant whose turn it is
+func (q *PgQueue) selectFair(ctx context.Context, tx *sql.Tx, conds selectConds) (record, error) {
+	if q.tenants == nil {
+		return q.selectFirst(ctx, tx, conds)
+	}
+
+	if q.tenants.discover() {
+		record, err := q.selectOtherTenants(ctx, tx, conds)
+		if err != EmptyQueueError {
+			return record, err
+		}
+	}
+
+	for _, turn := range q.tenants.turns() {
+		record, err := q.selectFirst(ctx, tx, conds.with(tenantCond, turn.tenant.name))
+		if err != nil {
+			q.tenants.cancel(turn, err == EmptyQueueError)
+			if err == EmptyQueueError {
+				continue
+			}
+			return record, err
+		}
+
+		q.tenants.dequeued(record.tenant)
+		return record, nil
+	}
+
+	return q.selectOtherTenants(ctx, tx, conds)
+}
+
+// Selects the record of the tenants which had no requests before
+func (q *PgQueue) selectOtherTenants(ctx context.Context, tx *sql.Tx, conds selectConds) (record, error) {
+	conds = conds.with(otherTenantsCond, pq.Array(q.tenants.activeNames()))
+
+	record, err := q.selectFirst(ctx, tx, conds)
+	if err != nil {
+		return record, err
+	}
+
+	q.tenants.found(record.tenant)
+
+	return record, nil
+}
+
+// Selects the record from the oldest non-empty partition
+func (q *PgQueue) selectFirst(ctx context.Context, tx *sql.Tx, conds selectConds) (record, error) {
+	tables := queueTables
+	if q.partitions != nil {
+		tables = q.partitions.Tables()
+	}
+
+	for _, table := range tables {
+		record, err := q.selectOne(ctx, tx, table, conds)
+		if err != EmptyQueueError {
+			return record, err
+		}
+	}
+
+	return record{}, EmptyQueueError
+}
+
+func (q *PgQueue) selectOne(ctx context.Context, tx *sql.Tx, table string, conds selectConds) (record, error) {
 	var (
 		id           string
-		headers      []byte
+		tenant       string
+		columns      payloadColumns
+		meta         []byte
 		proxyRequest Request
 		err          error
 		attempt      int
 	)
 
-	row := tx.QueryRowContext(ctx, querySQL)
+	row := tx.QueryRowContext(ctx, fmt.Sprintf(querySQL, table, conds.where()), conds.args...)
 
-	err = row.Scan(
-		&id,
-		&proxyRequest.Method,
-		&headers,
-		&proxyRequest.Body,
-		&proxyRequest.OriginURL,
-		&attempt,
-	)
+	dest := []interface{}{
+		&id, &proxyRequest.Method, &proxyRequest.OriginURL, &attempt, &meta, &tenant, &proxyRequest.createdAt,
+	}
+	err = row.Scan(append(dest, columns.dest()...)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return record{}, EmptyQueueError
@@ -187,10 +570,259 @@ func (q *PgQueue) selectOne(ctx context.Context, tx *sql.Tx) (record, error) {
 		return record{}, err
 	}
 
+	payload, err := columns.payload()
+	if err != nil {
+		return record{}, &payloadError{id: id, reason: "decode", err: err}
+	}
+
+	if err = q.loadBlob(ctx, &columns, payload); err != nil {
+		return record{}, &payloadError{id: id, reason: "blob", err: err}
+	}
+
+	// Unknown keys and corrupted payloads would fail on every attempt
+	headers, body, err := q.codec.Decode(id, payload)
+	if err != nil {
+		return record{}, &payloadError{id: id, reason: "decode", err: err}
+	}
+	proxyRequest.Body = body
+
 	err = json.Unmarshal(headers, &proxyRequest.Header)
 	if err != nil {
-		return record{}, err
+		return record{}, &payloadError{id: id, reason: "decode", err: err}
+	}
+
+	// Rows enqueued before metadata was introduced have none
+	if len(meta) > 0 {
+		err = json.Unmarshal(meta, &proxyRequest.Meta)
+		if err != nil {
+			return record{}, &payloadError{id: id, reason: "decode", err: err}
+		}
+	}
+
+	proxyRequest.ID = id
+	proxyRequest.Attempt = attempt
+	proxyRequest.bodyRef = columns.bodyRef.String
+
+	return record{&proxyRequest, id, attempt, table, tenant}, nil
+}
+
+// Conditions of the dequeued records with their arguments
+type selectConds struct {
+	conds []string
+	args  []interface{}
+}
+
+// Returns the copy with the condition added
+func (c selectConds) with(cond string, arg interface{}) selectConds {
+	args := append(append([]interface{}{}, c.args...), arg)
+	conds := append(append([]string{}, c.conds...), fmt.Sprintf(cond, len(args)))
+
+	return selectConds{conds: conds, args: args}
+}
+
+// Returns the copy with the condition without arguments added
+func (c selectConds) and(cond string) selectConds {
+	conds := append(append([]string{}, c.conds...), cond)
+
+	return selectConds{conds: conds, args: c.args}
+}
+
+func (c selectConds) where() string {
+	if len(c.conds) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(c.conds, " AND ")
+}
+
+// Reencrypt encrypts the payloads stored in plain or with the inactive
+// keys with the active one. Returns the number of updated rows.
+func (q *PgQueue) Reencrypt(ctx context.Context, batchSize int) (int, error) {
+	keyID, ok := q.codec.Encrypted()
+	if !ok {
+		return 0, errors.New("encryption keys are not configured")
+	}
+
+	total := 0
+	for {
+		n, err := q.reencryptBatch(ctx, keyID, batchSize)
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+
+		log.WithField("total", total).Info("Reencrypted requests")
+	}
+}
+
+func (q *PgQueue) reencryptBatch(ctx context.Context, keyID string, batchSize int) (int, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, selectNotReencryptedSQL, keyID, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var batch []reencryptedRow
+	for rows.Next() {
+		var (
+			id      string
+			columns payloadColumns
+		)
+
+		if err = rows.Scan(append([]interface{}{&id}, columns.dest()...)...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		r := reencryptedRow{id: id, oldRef: columns.bodyRef.String}
+
+		r.payload, err = columns.payload()
+		if err == nil {
+			err = q.loadBlob(ctx, &columns, r.payload)
+		}
+		if err == nil {
+			r.payload, err = q.reencrypt(id, r.payload)
+		}
+		if err == nil && r.oldRef != "" {
+			r.bodyRef, err = q.putBlob(ctx, len(r.payload.Body), r.payload)
+		}
+		if err != nil {
+			rows.Close()
+			q.deleteBatchBlobs(ctx, batch, false)
+			return 0, fmt.Errorf("request %s: %v", id, err)
+		}
+
+		batch = append(batch, r)
+	}
+	if err = rows.Err(); err != nil {
+		q.deleteBatchBlobs(ctx, batch, false)
+		return 0, err
+	}
+
+	for _, r := range batch {
+		_, err = tx.ExecContext(
+			ctx, updatePayloadSQL, r.id, r.payload.Header, r.payload.Body,
+			r.payload.HeaderFormat, r.payload.BodyFormat,
+			nullString(r.payload.KeyID), r.payload.DataKey, nullString(r.bodyRef),
+		)
+		if err != nil {
+			q.deleteBatchBlobs(ctx, batch, false)
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		q.deleteBatchBlobs(ctx, batch, false)
+		return 0, fmt.Errorf("commit error: %v", err)
 	}
 
-	return record{&proxyRequest, id, attempt}, nil
+	q.deleteBatchBlobs(ctx, batch, true)
+
+	return len(batch), nil
+}
+
+// Removes either the new blobs if the batch failed or the old ones
+func (q *PgQueue) deleteBatchBlobs(ctx context.Context, batch []reencryptedRow, old bool) {
+	for _, r := range batch {
+		if old {
+			q.deleteBlob(ctx, r.oldRef)
+		} else {
+			q.deleteBlob(ctx, r.bodyRef)
+		}
+	}
+}
+
+// Reencrypted payload and the blobs holding its body
+type reencryptedRow struct {
+	id      string
+	payload *codec.Payload
+	bodyRef string
+	oldRef  string
+}
+
+func (q *PgQueue) reencrypt(id string, payload *codec.Payload) (*codec.Payload, error) {
+	headers, body, err := q.codec.Decode(id, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.codec.Encode(id, headers, body)
+}
+
+// Stored payload columns. The rows enqueued before the binary columns
+// were introduced and not backfilled yet keep it in the legacy ones:
+// header varchar and body text with the encoded payloads in base64.
+type payloadColumns struct {
+	legacyHeader []byte
+	legacyBody   []byte
+	headerData   []byte
+	bodyData     []byte
+	headerFormat int
+	bodyFormat   int
+	keyID        sql.NullString
+	dataKey      []byte
+	bodyRef      sql.NullString
+}
+
+// Scan destinations in the order of the selected columns:
+// header, body, header_data, body_data, header_format, body_format, key_id, data_key, body_ref
+func (c *payloadColumns) dest() []interface{} {
+	return []interface{}{
+		&c.legacyHeader,
+		&c.legacyBody,
+		&c.headerData,
+		&c.bodyData,
+		&c.headerFormat,
+		&c.bodyFormat,
+		&c.keyID,
+		&c.dataKey,
+		&c.bodyRef,
+	}
+}
+
+func (c *payloadColumns) payload() (*codec.Payload, error) {
+	p := &codec.Payload{
+		HeaderFormat: c.headerFormat,
+		BodyFormat:   c.bodyFormat,
+		KeyID:        c.keyID.String,
+		DataKey:      c.dataKey,
+	}
+
+	// header_data is always set for the rows in the binary columns
+	if c.headerData == nil {
+		var err error
+		if p.Header, err = legacyColumn(c.legacyHeader, c.headerFormat); err != nil {
+			return nil, err
+		}
+		if p.Body, err = legacyColumn(c.legacyBody, c.bodyFormat); err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+
+	p.Header = c.headerData
+	p.Body = c.bodyData
+
+	return p, nil
+}
+
+func legacyColumn(value []byte, format int) ([]byte, error) {
+	if format == codec.FormatPlain {
+		return value, nil
+	}
+
+	result := make([]byte, base64.StdEncoding.DecodedLen(len(value)))
+	n, err := base64.StdEncoding.Decode(result, value)
+
+	return result[:n], err
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
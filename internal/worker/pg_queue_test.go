@@ -0,0 +1,367 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pressly/goose"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/blob"
+)
+
+// Runs the migrations and returns the config for the test database
+// set with ASYNCPROXY_TEST_DB, skips the test if it's not set
+func testDBConfig(t *testing.T) *cfg.Config {
+	t.Helper()
+
+	dsn := os.Getenv("ASYNCPROXY_TEST_DB")
+	if dsn == "" {
+		t.Skip("ASYNCPROXY_TEST_DB is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = goose.SetDialect("postgres"); err != nil {
+		t.Fatal(err)
+	}
+	if err = goose.Up(db, "../../migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("TRUNCATE proxy_requests"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &cfg.Config{}
+	config.Db.ConnectionString = dsn
+	config.Db.MaxConnections = 2
+	config.Db.UseIndex = true
+
+	return config
+}
+
+func TestPgQueueRoundTrip(t *testing.T) {
+	config := testDBConfig(t)
+
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := map[string][]byte{
+		"empty":        nil,
+		"nul":          []byte("a\x00b\x00"),
+		"invalid utf8": {0xff, 0xfe, 0xfd},
+		"gzip":         {0x1f, 0x8b, 0x08, 0x00},
+		"random":       random,
+		"text":         bytes.Repeat([]byte("<item>value</item>"), 100),
+	}
+
+	key := "test:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	t.Setenv("TEST_ASYNCPROXY_KEYS", key)
+
+	storages := map[string]func(*cfg.Config){
+		"plain": func(c *cfg.Config) {},
+		"compressed": func(c *cfg.Config) {
+			c.Queue.Compression = cfg.Compression{MinSize: 1, Headers: true}
+		},
+		"encrypted": func(c *cfg.Config) {
+			c.Queue.Encryption = cfg.Encryption{KeyEnv: "TEST_ASYNCPROXY_KEYS"}
+		},
+		"blob": func(c *cfg.Config) {
+			c.Queue.Blob = cfg.Blob{Type: "fs", Dir: t.TempDir(), MinSize: 1}
+		},
+	}
+
+	for storage, configure := range storages {
+		storageConfig := *config
+		configure(&storageConfig)
+
+		queue, err := NewPgQueue(&storageConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, body := range bodies {
+			r := &Request{
+				ID:        storage + "-" + name,
+				Method:    "POST",
+				Header:    http.Header{"Content-Type": {"application/octet-stream"}},
+				Body:      body,
+				OriginURL: "/hooks?a=b",
+				Meta:      map[string]string{MetaProducer: "billing"},
+			}
+
+			if err = queue.EnqueueRequest(r, 2); err != nil {
+				t.Fatalf("%s %s: enqueue error: %s", storage, name, err)
+			}
+
+			dequeued, attempt, err := queue.DequeueRequest(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("%s %s: dequeue error: %s", storage, name, err)
+			}
+
+			if !bytes.Equal(dequeued.Body, body) {
+				t.Errorf("%s %s: expected the same body: %q", storage, name, dequeued.Body)
+			}
+			if !reflect.DeepEqual(dequeued.Header, r.Header) || !reflect.DeepEqual(dequeued.Meta, r.Meta) {
+				t.Errorf("%s %s: expected the same header and meta: %v %v", storage, name, dequeued.Header, dequeued.Meta)
+			}
+			if dequeued.ID != r.ID || attempt != 2 {
+				t.Errorf("%s %s: expected the same id and attempt: %s %d", storage, name, dequeued.ID, attempt)
+			}
+		}
+
+		queue.Shutdown()
+	}
+}
+
+func TestPgQueueLegacyRows(t *testing.T) {
+	config := testDBConfig(t)
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	_, err = queue.db.Exec(`
+    INSERT INTO proxy_requests (timestamp, id, method, header, body, origin_url, attempt)
+    VALUES (now(), 'legacy', 'POST', '{"Content-Type":["text/plain"]}', 'hello', '/hooks', 1);
+  `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := queue.DequeueRequest(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(r.Body) != "hello" || r.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("expected legacy row to be readable: %q %v", r.Body, r.Header)
+	}
+}
+
+func TestPgQueueBlobs(t *testing.T) {
+	config := testDBConfig(t)
+	config.Queue.Blob = cfg.Blob{Type: "fs", Dir: t.TempDir(), MinSize: 16}
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	body := bytes.Repeat([]byte("large"), 10)
+	r := &Request{ID: "large", Method: "POST", Body: body, OriginURL: "/hooks"}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if err = queue.EnqueueRequest(r, attempt); err != nil {
+			t.Fatal(err)
+		}
+
+		var inline []byte
+		if err = queue.db.QueryRow("SELECT body_data FROM proxy_requests WHERE id = 'large'").Scan(&inline); err != nil {
+			t.Fatal(err)
+		}
+		if inline != nil {
+			t.Errorf("expected body to be moved to the blob store: %q", inline)
+		}
+
+		if r, _, err = queue.DequeueRequest(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(r.Body, body) {
+			t.Errorf("expected the same body: %q", r.Body)
+		}
+	}
+
+	// The blob of the first attempt is removed on retry
+	files, _ := ioutil.ReadDir(config.Queue.Blob.Dir)
+	if len(files) != 1 {
+		t.Errorf("expected one blob, got %d", len(files))
+	}
+
+	queue.Complete(context.Background(), r)
+
+	files, _ = ioutil.ReadDir(config.Queue.Blob.Dir)
+	if len(files) != 0 {
+		t.Errorf("expected blob to be removed after completion, got %d", len(files))
+	}
+}
+
+func TestPgQueueMissingBlob(t *testing.T) {
+	config := testDBConfig(t)
+	config.Queue.Blob = cfg.Blob{Type: "fs", Dir: t.TempDir(), MinSize: 16}
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	large := &Request{ID: "large", Method: "POST", Body: bytes.Repeat([]byte("large"), 10), OriginURL: "/hooks"}
+	if err = queue.EnqueueRequest(large, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(config.Queue.Blob.Dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = queue.db.Exec("UPDATE proxy_requests SET timestamp = timestamp - interval '1 hour'"); err != nil {
+		t.Fatal(err)
+	}
+
+	small := &Request{ID: "small", Method: "POST", Body: []byte("small"), OriginURL: "/hooks"}
+	if err = queue.EnqueueRequest(small, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, _, err = queue.DequeueRequest(ctx, nil); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("expected missing blob error, got %v", err)
+	}
+
+	// The broken row is postponed and doesn't block the next ones
+	r, _, err := queue.DequeueRequest(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "small" {
+		t.Errorf("expected the next request, got %s", r.ID)
+	}
+
+	if _, _, err = queue.DequeueRequest(ctx, nil); err != EmptyQueueError {
+		t.Errorf("expected the postponed request to stay in the queue, got %v", err)
+	}
+	if total := queue.Total(); total != 1 {
+		t.Errorf("expected the postponed request to be kept, got %d", total)
+	}
+}
+
+func TestPgQueueUnknownKey(t *testing.T) {
+	config := testDBConfig(t)
+
+	t.Setenv("TEST_ASYNCPROXY_KEYS", "old:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	config.Queue.Encryption = cfg.Encryption{KeyEnv: "TEST_ASYNCPROXY_KEYS"}
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Request{ID: "old", Method: "POST", Body: []byte("secret"), OriginURL: "/hooks"}
+	if err = queue.EnqueueRequest(r, 1); err != nil {
+		t.Fatal(err)
+	}
+	queue.Shutdown()
+
+	// The old key is removed before the request is reencrypted
+	t.Setenv("TEST_ASYNCPROXY_KEYS", "new:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+
+	if queue, err = NewPgQueue(config); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	ctx := context.Background()
+	var payloadErr *payloadError
+	if _, _, err = queue.DequeueRequest(ctx, nil); !errors.As(err, &payloadErr) || payloadErr.reason != "decode" {
+		t.Fatalf("expected decode error, got %v", err)
+	}
+
+	if _, _, err = queue.DequeueRequest(ctx, nil); err != EmptyQueueError {
+		t.Errorf("expected the request to be postponed, got %v", err)
+	}
+	if total := queue.Total(); total != 1 {
+		t.Errorf("expected the postponed request to be kept, got %d", total)
+	}
+}
+
+func TestPgQueueOldestAgeAcrossRetries(t *testing.T) {
+	config := testDBConfig(t)
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	if err = queue.EnqueueRequest(&Request{ID: "retried", Method: "POST", OriginURL: "/hooks"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = queue.db.Exec("UPDATE proxy_requests SET created_at = created_at - interval '1 hour'"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, attempt, err := queue.DequeueRequest(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry is enqueued with the new timestamp but keeps the age
+	if err = queue.DeferRequest(r, attempt+1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	age, err := queue.OldestAge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age < time.Hour || age > time.Hour+time.Minute {
+		t.Errorf("expected the age since the first enqueue, got %s", age)
+	}
+}
+
+func TestBlobCollector(t *testing.T) {
+	config := testDBConfig(t)
+	config.Queue.Blob = cfg.Blob{Type: "fs", Dir: t.TempDir(), MinSize: 16}
+
+	queue, err := NewPgQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Shutdown()
+
+	ctx := context.Background()
+
+	r := &Request{ID: "queued", Method: "POST", Body: bytes.Repeat([]byte("large"), 10), OriginURL: "/hooks"}
+	if err = queue.EnqueueRequest(r, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = queue.blobs.Put(ctx, "orphaned", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checks the blobs stored up to now
+	c := &blobCollector{db: queue.db, blobs: queue.blobs, grace: -time.Minute}
+
+	deleted, err := c.collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected the orphaned blob to be deleted, deleted %d", deleted)
+	}
+
+	if _, err = queue.blobs.Get(ctx, "orphaned"); !errors.Is(err, blob.ErrNotFound) {
+		t.Errorf("expected the orphaned blob to be deleted, got %v", err)
+	}
+	if _, err = queue.blobs.Get(ctx, r.bodyRef); err != nil {
+		t.Errorf("expected the blob of the queued request to be kept: %s", err)
+	}
+}
@@ -2,11 +2,22 @@ package worker
 
 import (
 	"context"
+	"time"
 )
 
 type Queue interface {
 	Total() uint64
+	// TenantTotals returns the number of requests by tenant
+	TenantTotals() (map[string]uint64, error)
+	// OldestAge returns the age of the oldest request, 0 if it's empty
+	OldestAge() (time.Duration, error)
 	Shutdown() error
 	EnqueueRequest(r *Request, attempt int) error
-	DequeueRequest(ctx context.Context) (r *Request, attempt int, err error)
+	// DeferRequest enqueues the request to be dequeued after the delay
+	DeferRequest(r *Request, attempt int, delay time.Duration) error
+	// DequeueRequest takes the request skipping the ones to the destinations
+	DequeueRequest(ctx context.Context, skip []string) (r *Request, attempt int, err error)
+
+	// Complete releases the resources of the request delivered or dropped
+	Complete(ctx context.Context, r *Request)
 }
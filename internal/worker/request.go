@@ -8,15 +8,57 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Keys of the request metadata
+const (
+	// Name of the authenticated producer
+	MetaProducer = "producer"
+
+	// Subject of the verified client TLS certificate
+	MetaClientSubject = "client_subject"
+
+	// Address and protocol the request came from
+	MetaClientIP = "client_ip"
+	MetaProto    = "proto"
+
+	// Name of the route chosen by the filters
+	MetaRoute = "route"
+
+	// Comma-separated tags set by the filters
+	MetaTags = "tags"
+
+	// Tenant the request belongs to, see tenant.Resolver
+	MetaTenant = "tenant"
+
+	// Name of the upstream the request was enqueued for
+	MetaDestination = "destination"
 )
 
 // Need to store HTTP request properties to allow goroutines handle
 // them asynchronously and thread-safe.
 type Request struct {
+	ID        string
 	Header    http.Header
 	Method    string
 	Body      []byte
 	OriginURL string
+
+	// Details about the incoming request, not proxied
+	Meta map[string]string
+
+	// Number of the delivery attempt
+	Attempt int
+
+	// Key of the stored body in the blob store, empty if it's not there
+	bodyRef string
+
+	// Time of the first enqueue kept across the retries, zero until
+	// the request is dequeued. It's the database time without zone.
+	createdAt time.Time
 }
 
 func NewRequest(r *http.Request) (*Request, error) {
@@ -25,12 +67,30 @@ func NewRequest(r *http.Request) (*Request, error) {
 		return nil, err
 	}
 
+	request := NewStreamedRequest(r)
+	request.Body = body
+
+	return request, nil
+}
+
+// NewStreamedRequest copies the request leaving the body unread
+func NewStreamedRequest(r *http.Request) *Request {
+	meta := map[string]string{
+		MetaClientIP: clientIP(r),
+		MetaProto:    proto(r),
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		meta[MetaClientSubject] = r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+
 	return &Request{
+		ID:        uuid.New().String(),
 		Header:    r.Header.Clone(),
 		Method:    r.Method,
-		Body:      body,
 		OriginURL: r.URL.String(),
-	}, nil
+		Meta:      meta,
+		Attempt:   1,
+	}
 }
 
 func (r *Request) URL() (*url.URL, error) {
@@ -60,12 +120,32 @@ func (r *Request) ToHTTPRequest(ctx context.Context, host, scheme string) (*http
 		return nil, err
 	}
 
-	httpReq.Header = r.Header
+	// Keep the stored headers intact when the outgoing ones are modified
+	httpReq.Header = r.Header.Clone()
 	httpReq.Close = true
 
+	removeHopHeaders(httpReq.Header)
+	addForwardedHeaders(httpReq.Header, r.Meta[MetaClientIP], r.Meta[MetaProto])
+
 	return httpReq, nil
 }
 
 func (r *Request) String() string {
 	return fmt.Sprintf("%s %s", r.Method, r.OriginURL)
 }
+
+func (r *Request) headerData() headerData {
+	data := headerData{
+		RequestID: r.ID,
+		ClientIP:  r.Meta[MetaClientIP],
+		Producer:  r.Meta[MetaProducer],
+		Method:    r.Method,
+		Attempt:   r.Attempt,
+	}
+
+	if reqURL, err := r.URL(); err == nil {
+		data.Path = reqURL.Path
+	}
+
+	return data
+}
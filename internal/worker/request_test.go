@@ -0,0 +1,49 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestToHTTPRequestHeaders(t *testing.T) {
+	r := &Request{
+		Header: http.Header{
+			"Connection":      {"keep-alive, X-Hop"},
+			"X-Hop":           {"1"},
+			"Keep-Alive":      {"timeout=5"},
+			"Content-Length":  {"100"},
+			"Content-Type":    {"application/xml"},
+			"X-Forwarded-For": {"10.0.0.1"},
+		},
+		Method:    "POST",
+		OriginURL: "/notifications",
+		Meta:      map[string]string{MetaClientIP: "::1", MetaProto: "https"},
+	}
+
+	httpReq, err := r.ToHTTPRequest(context.Background(), "remote", "http")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Content-Length"} {
+		if httpReq.Header.Get(name) != "" {
+			t.Errorf("expected %s header to be removed", name)
+		}
+	}
+	if httpReq.Header.Get("Content-Type") != "application/xml" {
+		t.Errorf("expected end-to-end headers to be kept")
+	}
+	if xff := httpReq.Header.Get("X-Forwarded-For"); xff != "10.0.0.1, ::1" {
+		t.Errorf("expected client IP to be appended: %s", xff)
+	}
+	if proto := httpReq.Header.Get("X-Forwarded-Proto"); proto != "https" {
+		t.Errorf("expected X-Forwarded-Proto: %s", proto)
+	}
+	if fwd := httpReq.Header.Get("Forwarded"); fwd != `for="[::1]";proto=https` {
+		t.Errorf("expected Forwarded header: %s", fwd)
+	}
+	if r.Header.Get("Connection") == "" {
+		t.Errorf("expected stored headers to be kept intact")
+	}
+}
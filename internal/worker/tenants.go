@@ -0,0 +1,293 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+var (
+	tenantDequeuedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_tenant_dequeued_total",
+		Help: "Number of requests dequeued by tenant.",
+	}, []string{"tenant"})
+
+	tenantThrottledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_tenant_throttled_total",
+		Help: "Number of times the tenant was skipped by its rate limit.",
+	}, []string{"tenant"})
+)
+
+// Takes turns between the tenants with the queued requests.
+// Each tenant gets its weight of dequeues in a row within its rate limit.
+type tenantScheduler struct {
+	rate   int
+	burst  int
+	limits map[string]cfg.TenantLimit
+
+	mu sync.Mutex
+
+	// Tenants which had the requests last time, in the order of turns
+	active []*tenantState
+	cursor int
+	served int
+
+	// Whether to look for the requests of the other tenants,
+	// it's done once a round
+	discovering bool
+
+	// All the tenants seen, keeps their limiters
+	tenants map[string]*tenantState
+}
+
+type tenantState struct {
+	name    string
+	weight  int
+	limiter *rate.Limiter
+}
+
+// A reserved turn of the tenant
+type tenantTurn struct {
+	tenant      *tenantState
+	reservation *rate.Reservation
+}
+
+// Returns nil if the tenants are not configured
+func newTenantScheduler(config cfg.Tenants) (*tenantScheduler, error) {
+	if config.Source == "" {
+		return nil, nil
+	}
+
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("tenant rate must be >= 0: %d", config.Rate)
+	}
+
+	s := &tenantScheduler{
+		rate:        config.Rate,
+		burst:       config.Burst,
+		limits:      make(map[string]cfg.TenantLimit, len(config.Limits)),
+		tenants:     map[string]*tenantState{},
+		discovering: true,
+	}
+
+	for _, l := range config.Limits {
+		if _, ok := s.limits[l.Tenant]; ok || l.Tenant == "" {
+			return nil, fmt.Errorf("tenant must be unique and not empty: %q", l.Tenant)
+		}
+		if l.Rate < 0 || l.Weight < 0 {
+			return nil, fmt.Errorf("tenant %s: rate and weight must be >= 0", l.Tenant)
+		}
+
+		s.limits[l.Tenant] = l
+	}
+
+	return s, nil
+}
+
+// Reserves the turns of the active tenants within their limits
+// starting from the current one. Unused turns must be cancelled.
+func (s *tenantScheduler) turns() []tenantTurn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	turns := make([]tenantTurn, 0, len(s.active))
+	for i := range s.active {
+		t := s.active[(s.cursor+i)%len(s.active)]
+
+		turn := tenantTurn{tenant: t}
+		if t.limiter != nil {
+			turn.reservation = t.limiter.Reserve()
+			if turn.reservation.Delay() > 0 {
+				turn.reservation.Cancel()
+				tenantThrottledCounter.WithLabelValues(t.name).Inc()
+				continue
+			}
+		}
+
+		turns = append(turns, turn)
+	}
+
+	return turns
+}
+
+// Reports whether it's time to look for the other tenants
+func (s *tenantScheduler) discover() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.discovering
+	s.discovering = false
+
+	if d {
+		s.prune(time.Now())
+	}
+
+	return d
+}
+
+// Forgets the tenants out of the rotation whose limiters are full,
+// they behave the same as the new ones
+func (s *tenantScheduler) prune(now time.Time) {
+	active := make(map[*tenantState]bool, len(s.active))
+	for _, t := range s.active {
+		active[t] = true
+	}
+
+	for name, t := range s.tenants {
+		if active[t] {
+			continue
+		}
+
+		if t.limiter != nil {
+			r := t.limiter.ReserveN(now, t.limiter.Burst())
+			full := r.OK() && r.DelayFrom(now) == 0
+			r.CancelAt(now)
+
+			if !full {
+				continue
+			}
+		}
+
+		delete(s.tenants, name)
+	}
+}
+
+// Names of the active tenants
+func (s *tenantScheduler) activeNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, len(s.active))
+	for i, t := range s.active {
+		names[i] = t.name
+	}
+
+	return names
+}
+
+// Gives the turn back, the tenant had no requests
+func (s *tenantScheduler) cancel(turn tenantTurn, empty bool) {
+	if turn.reservation != nil {
+		turn.reservation.Cancel()
+	}
+
+	if !empty {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.active {
+		if t != turn.tenant {
+			continue
+		}
+
+		s.active = append(s.active[:i], s.active[i+1:]...)
+		if i < s.cursor {
+			s.cursor--
+		} else if i == s.cursor {
+			s.served = 0
+		}
+		if s.cursor >= len(s.active) {
+			s.cursor = 0
+		}
+
+		return
+	}
+}
+
+// Counts the dequeue of the tenant, moves to the next one
+// when the tenant has used its weight
+func (s *tenantScheduler) dequeued(name string) {
+	tenantDequeuedCounter.WithLabelValues(name).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.activate(name)
+	if i == s.cursor {
+		s.served++
+	} else {
+		s.cursor, s.served = i, 1
+	}
+
+	if s.served >= s.active[i].weight {
+		s.cursor, s.served = (i+1)%len(s.active), 0
+		s.discovering = s.discovering || s.cursor == 0
+	}
+}
+
+// Dequeued the request of the tenant which wasn't active, counts
+// it against the tenant limit
+func (s *tenantScheduler) found(name string) {
+	s.mu.Lock()
+	t := s.tenants[name]
+	if t == nil {
+		t = s.newTenant(name)
+	}
+	s.mu.Unlock()
+
+	if t.limiter != nil {
+		t.limiter.Reserve()
+	}
+
+	s.dequeued(name)
+}
+
+// Returns the index of the active tenant adding it if needed
+func (s *tenantScheduler) activate(name string) int {
+	for i, t := range s.active {
+		if t.name == name {
+			return i
+		}
+	}
+
+	t := s.tenants[name]
+	if t == nil {
+		t = s.newTenant(name)
+	}
+
+	// New tenants get their next turn after the others
+	if len(s.active) == 0 {
+		s.active = append(s.active, t)
+		return 0
+	}
+
+	i := s.cursor
+	s.active = append(s.active[:i], append([]*tenantState{t}, s.active[i:]...)...)
+	s.cursor++
+
+	return i
+}
+
+func (s *tenantScheduler) newTenant(name string) *tenantState {
+	t := &tenantState{name: name, weight: 1}
+
+	r, burst := s.rate, s.burst
+	if l, ok := s.limits[name]; ok {
+		if l.Rate > 0 {
+			r, burst = l.Rate, l.Burst
+		}
+		if l.Weight > 0 {
+			t.weight = l.Weight
+		}
+	}
+
+	if r > 0 {
+		if burst < 1 {
+			burst = r
+		}
+		t.limiter = rate.NewLimiter(rate.Limit(r), burst)
+	}
+
+	s.tenants[name] = t
+
+	return t
+}
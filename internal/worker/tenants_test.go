@@ -0,0 +1,140 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+)
+
+// Dequeues from the tenant in turn discovering the new ones
+// as PgQueue does
+func nextTenant(s *tenantScheduler, queued map[string]int) string {
+	if s.discover() {
+		if name := nextOtherTenant(s, queued); name != "" {
+			return name
+		}
+	}
+
+	for _, turn := range s.turns() {
+		if queued[turn.tenant.name] == 0 {
+			s.cancel(turn, true)
+			continue
+		}
+
+		queued[turn.tenant.name]--
+		s.dequeued(turn.tenant.name)
+		return turn.tenant.name
+	}
+
+	return nextOtherTenant(s, queued)
+}
+
+func nextOtherTenant(s *tenantScheduler, queued map[string]int) string {
+	active := s.activeNames()
+	for _, name := range []string{"a", "b", "c"} {
+		if queued[name] > 0 && !contains(active, name) {
+			queued[name]--
+			s.found(name)
+			return name
+		}
+	}
+
+	return ""
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTenantScheduler(t *testing.T) {
+	s, err := newTenantScheduler(cfg.Tenants{
+		Source: "header",
+		Limits: []cfg.TenantLimit{{Tenant: "a", Weight: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := map[string]int{"a": 10, "b": 3, "c": 1}
+
+	var got []string
+	for i := 0; i < 8; i++ {
+		got = append(got, nextTenant(s, queued))
+	}
+
+	// New tenants are looked for once a round
+	want := []string{"a", "a", "b", "a", "a", "c", "b", "a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected turns %v, got %v", want, got)
+	}
+}
+
+func TestTenantSchedulerRate(t *testing.T) {
+	s, err := newTenantScheduler(cfg.Tenants{
+		Source: "header",
+		Rate:   1,
+		Limits: []cfg.TenantLimit{{Tenant: "b", Rate: 100}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := map[string]int{"a": 10, "b": 10}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, nextTenant(s, queued))
+	}
+
+	// a is limited to one request per second
+	want := []string{"a", "b", "b", "b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected turns %v, got %v", want, got)
+	}
+}
+
+func TestTenantSchedulerPrune(t *testing.T) {
+	s, err := newTenantScheduler(cfg.Tenants{Source: "route", Rate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := map[string]int{"a": 1, "b": 1, "c": 1}
+	for i := 0; i < 3; i++ {
+		nextTenant(s, queued)
+	}
+
+	// The empty tenants drop out of the rotation, but their limiters are used
+	for _, tenant := range append([]*tenantState{}, s.active...) {
+		s.cancel(tenantTurn{tenant: tenant}, true)
+	}
+	s.prune(time.Now())
+	if len(s.active) != 0 || len(s.tenants) != 3 {
+		t.Fatalf("expected inactive tenants with used limits: %d %d", len(s.active), len(s.tenants))
+	}
+
+	s.prune(time.Now().Add(time.Second))
+	if len(s.tenants) != 0 {
+		t.Errorf("expected inactive tenants with full limits to be forgotten: %d", len(s.tenants))
+	}
+}
+
+func TestNewTenantSchedulerErrors(t *testing.T) {
+	for _, config := range []cfg.Tenants{
+		{Source: "header", Rate: -1},
+		{Source: "header", Limits: []cfg.TenantLimit{{Tenant: ""}}},
+		{Source: "header", Limits: []cfg.TenantLimit{{Tenant: "a"}, {Tenant: "a"}}},
+		{Source: "header", Limits: []cfg.TenantLimit{{Tenant: "a", Weight: -1}}},
+	} {
+		if _, err := newTenantScheduler(config); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
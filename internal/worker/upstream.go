@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+
+	cfg "github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/oauth2"
+	"github.com/evilmartians/asyncproxy/internal/tlsconfig"
+)
+
+// Destination server the requests are proxied to
+type upstream struct {
+	name string
+
+	client *http.Client
+
+	// Reverse proxy for the synchronous routes
+	forwarder *httputil.ReverseProxy
+
+	remoteHost, remoteScheme string
+
+	// Outbound limits, nil if unlimited
+	limits *upstreamLimits
+}
+
+func newUpstream(uc cfg.Upstream, config *cfg.Config) (*upstream, error) {
+	name := uc.Name
+
+	remoteURL, err := url.Parse(uc.RemoteUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := tlsconfig.Client(uc.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %s", name, err)
+	}
+
+	tokens, err := oauth2.NewTokenSource(uc.OAuth2)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %s", name, err)
+	}
+
+	limits, err := newUpstreamLimits(name, uc.Limits, config.Proxy.NumClients)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"upstream":     name,
+		"redirect_url": fmt.Sprintf("%s://%s", remoteURL.Scheme, remoteURL.Host),
+		"tls":          tlsConfig != nil,
+		"oauth2":       tokens != nil,
+		"rate":         uc.Limits.Rate,
+		"concurrency":  uc.Limits.MaxConcurrency,
+		"adaptive":     uc.Limits.Adaptive.Enabled,
+	}).Info("Initializing upstream")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Limit open file descriptors
+	transport.MaxConnsPerHost = config.Proxy.NumClients
+	transport.MaxIdleConnsPerHost = config.Proxy.NumClients
+
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if tokens != nil {
+		roundTripper = &oauth2.Transport{Base: transport, Source: tokens}
+	}
+
+	u := &upstream{
+		name: name,
+		client: &http.Client{
+			Timeout:   config.Proxy.RequestTimeout,
+			Transport: roundTripper,
+		},
+		remoteHost:   remoteURL.Host,
+		remoteScheme: remoteURL.Scheme,
+		limits:       limits,
+	}
+
+	u.forwarder = &httputil.ReverseProxy{
+		Rewrite:      u.rewrite,
+		Transport:    roundTripper,
+		ErrorHandler: forwardError,
+	}
+
+	return u, nil
+}
+
+// Points the outgoing request to the remote server
+func (u *upstream) direct(r *http.Request) {
+	r.URL.Host = u.remoteHost
+	r.URL.Scheme = u.remoteScheme
+	r.Host = u.remoteHost
+}
+
+// Points the forwarded request to the remote server and sets the same
+// forwarding headers as the asynchronous deliveries get
+func (u *upstream) rewrite(pr *httputil.ProxyRequest) {
+	// The reverse proxy removes them from the outgoing request
+	for _, name := range []string{"X-Forwarded-For", "Forwarded"} {
+		if values := pr.In.Header.Values(name); len(values) > 0 {
+			pr.Out.Header[name] = values
+		}
+	}
+
+	u.direct(pr.Out)
+	addForwardedHeaders(pr.Out.Header, clientIP(pr.In), proto(pr.In))
+}
+
+func forwardError(w http.ResponseWriter, r *http.Request, err error) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.err = err
+	}
+
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"url":    r.URL.String(),
+	}).WithError(err).Error("forward error")
+
+	// The incoming body exceeded the route limit
+	if errors.As(err, new(*http.MaxBytesError)) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.WriteHeader(http.StatusBadGateway)
+}
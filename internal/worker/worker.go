@@ -2,10 +2,14 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 
@@ -14,6 +18,14 @@ import (
 
 type sendProxyRequestFunc func(context.Context, *Request) error
 
+// How often the queue depth is counted
+const totalInterval = time.Second
+
+var permanentErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "queue_permanent_errors_total",
+	Help: "Number of queued requests dropped without retries because they can't be sent.",
+}, []string{"reason"})
+
 type Worker struct {
 	numWorkers int
 	maxRetries int
@@ -21,14 +33,27 @@ type Worker struct {
 	limiter    *rate.Limiter
 	backoff    backoff.Backoff
 
+	// Defer the retries over the budget, nil if not configured
+	retryBudgets *retryBudgets
+
+	// Finds the destinations of the requests and the saturated ones,
+	// nil to dequeue any request
+	client *Client
+
 	works sync.WaitGroup
+
+	// Queue depth counted in the background, see Total
+	total    atomic.Uint64
+	totalAt  atomic.Int64
+	counting atomic.Bool
 }
 
-func NewWorker(config *cfg.Config) *Worker {
+func NewWorker(config *cfg.Config, client *Client) *Worker {
 	log.WithFields(log.Fields{
 		"workers":           config.Queue.Workers,
 		"handle_per_second": config.Queue.HandlePerSecond,
 		"max_retries":       config.Queue.MaxRetries,
+		"retry_budget":      config.Queue.RetryBudget.Ratio,
 	}).Info("Initializing worker")
 
 	queue, err := NewPgQueue(config)
@@ -36,6 +61,14 @@ func NewWorker(config *cfg.Config) *Worker {
 		log.Fatal(err)
 	}
 
+	if err = queue.ManagePartitions(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = queue.CollectBlobs(); err != nil {
+		log.Fatal(err)
+	}
+
 	if config.Queue.Workers < 1 {
 		log.Fatal("workers must be >= 1")
 	}
@@ -44,11 +77,18 @@ func NewWorker(config *cfg.Config) *Worker {
 		log.Fatal("max rps must be >= 1")
 	}
 
-	return &Worker{
-		numWorkers: config.Queue.Workers,
-		maxRetries: config.Queue.MaxRetries,
-		queue:      queue,
-		limiter:    rate.NewLimiter(rate.Limit(config.Queue.HandlePerSecond), config.Queue.HandlePerSecond),
+	budgets, err := newRetryBudgets(config.Queue.RetryBudget)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := &Worker{
+		numWorkers:   config.Queue.Workers,
+		maxRetries:   config.Queue.MaxRetries,
+		queue:        queue,
+		client:       client,
+		retryBudgets: budgets,
+		limiter:      rate.NewLimiter(rate.Limit(config.Queue.HandlePerSecond), config.Queue.HandlePerSecond),
 		backoff: backoff.Backoff{
 			Min:    10 * time.Millisecond,
 			Max:    5 * time.Second,
@@ -56,6 +96,11 @@ func NewWorker(config *cfg.Config) *Worker {
 			Jitter: true,
 		},
 	}
+
+	w.total.Store(queue.Total())
+	w.totalAt.Store(time.Now().UnixNano())
+
+	return w
 }
 
 // Gracefully stops all goroutines
@@ -101,9 +146,89 @@ func (w *Worker) Run(ctx context.Context, stopped <-chan struct{}, fn sendProxyR
 }
 
 func (w *Worker) Enqueue(r *Request) error {
+	w.setDestination(r)
+
 	return w.queue.EnqueueRequest(r, 1)
 }
 
+// Retry enqueues the request failed to be sent directly as the second
+// attempt, the first one is already counted by Fresh. The request
+// is deferred if the retry budget of its destination is exhausted.
+func (w *Worker) Retry(r *Request) error {
+	w.setDestination(r)
+
+	return w.queue.DeferRequest(r, 2, w.retryDelay(r))
+}
+
+func (w *Worker) setDestination(r *Request) {
+	if w.client != nil {
+		r.Meta[MetaDestination] = w.client.Destination(r)
+	}
+}
+
+// Total returns the number of requests in the queue. It's counted
+// in the background at most once per totalInterval, so the callers
+// don't run COUNT(*) on the large queue.
+func (w *Worker) Total() uint64 {
+	stale := time.Since(time.Unix(0, w.totalAt.Load())) >= totalInterval
+	if stale && w.counting.CompareAndSwap(false, true) {
+		go func() {
+			defer w.counting.Store(false)
+
+			w.total.Store(w.queue.Total())
+			w.totalAt.Store(time.Now().UnixNano())
+		}()
+	}
+
+	return w.total.Load()
+}
+
+// Fresh adds the first delivery attempt of the request, either sent
+// directly or dequeued, to the retry budget of its destination
+func (w *Worker) Fresh(r *Request) {
+	if w.retryBudgets == nil {
+		return
+	}
+
+	w.retryBudgets.get(w.destination(r)).deposit()
+}
+
+// Takes a retry from the budget of the request destination. Returns
+// the delay to retry later when the upstream gets more retries than
+// the budget, 0 to retry right away.
+func (w *Worker) retryDelay(r *Request) time.Duration {
+	if w.retryBudgets == nil {
+		return 0
+	}
+
+	budget := w.retryBudgets.get(w.destination(r))
+	if budget.withdraw() {
+		return 0
+	}
+
+	return budget.deferDelay
+}
+
+// Returns the upstream of the request, the rows enqueued before
+// the destinations were stored have none
+func (w *Worker) destination(r *Request) string {
+	if d := r.Meta[MetaDestination]; d != "" || w.client == nil {
+		return d
+	}
+
+	return w.client.Destination(r)
+}
+
+// Queue returns the queue of the workers
+func (w *Worker) Queue() Queue {
+	return w.queue
+}
+
+// OldestAge returns the age of the oldest request in the queue
+func (w *Worker) OldestAge() (time.Duration, error) {
+	return w.queue.OldestAge()
+}
+
 // Dequeues request and sends it to the destination
 // Uses a limiter to balance the outgoing load
 func (w *Worker) Work(ctx context.Context, stopped <-chan struct{}, fn sendProxyRequestFunc) {
@@ -121,8 +246,14 @@ func (w *Worker) Work(ctx context.Context, stopped <-chan struct{}, fn sendProxy
 		attempt int
 	)
 	for {
+		// Leave the requests to the saturated upstreams in the queue
+		var skip []string
+		if w.client != nil {
+			skip = w.client.Saturated()
+		}
+
 		var err error
-		request, attempt, err = w.queue.DequeueRequest(ctx)
+		request, attempt, err = w.queue.DequeueRequest(ctx, skip)
 		if err == nil {
 			break
 		}
@@ -143,22 +274,43 @@ func (w *Worker) Work(ctx context.Context, stopped <-chan struct{}, fn sendProxy
 
 	w.backoff.Reset()
 
+	if attempt == 1 {
+		w.Fresh(request)
+	}
+
 	// Try handling the request once again
 	if err := fn(ctx, request); err != nil {
+		var permanent *PermanentError
+		if errors.As(err, &permanent) {
+			permanentErrorsCounter.WithLabelValues(permanent.Reason).Inc()
+			log.WithFields(log.Fields{
+				"method": request.Method,
+				"url":    request.OriginURL,
+				"error":  err,
+			}).Warn("permanent error, dropping request")
+			w.queue.Complete(ctx, request)
+			return
+		}
+
 		if attempt > w.maxRetries {
 			log.WithFields(log.Fields{
 				"method":  request.Method,
 				"url":     request.OriginURL,
 				"retries": attempt,
 			}).Warn("max attempts exceded")
+			w.queue.Complete(ctx, request)
 			return
 		}
 
-		if err = w.queue.EnqueueRequest(request, attempt+1); err != nil {
+		if err = w.queue.DeferRequest(request, attempt+1, w.retryDelay(request)); err != nil {
 			log.WithFields(log.Fields{
 				"request": request.String(),
 				"error":   err,
 			}).Warn("couldn't retry request")
+			w.queue.Complete(ctx, request)
 		}
+		return
 	}
+
+	w.queue.Complete(ctx, request)
 }
@@ -3,34 +3,68 @@ package worker
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
 type testQueue struct {
-	dequeued int
-	enqueued int
+	dequeued  int
+	enqueued  int
+	completed int
+	deferred  time.Duration
+
+	// Attempt of the last enqueued request
+	attempt int
+
+	// Destination of the dequeued requests
+	destination string
+
+	totals atomic.Int32
 }
 
 func (t *testQueue) Total() uint64 {
+	t.totals.Add(1)
 	return 1
 }
 
+func (t *testQueue) TenantTotals() (map[string]uint64, error) {
+	return nil, nil
+}
+
+func (t *testQueue) OldestAge() (time.Duration, error) {
+	return 0, nil
+}
+
 func (t *testQueue) Shutdown() error {
 	return nil
 }
 
 func (t *testQueue) EnqueueRequest(r *Request, attempt int) error {
 	t.enqueued += 1
+	t.attempt = attempt
 
 	return nil
 }
 
-func (t *testQueue) DequeueRequest(ctx context.Context) (r *Request, attempt int, err error) {
+func (t *testQueue) DeferRequest(r *Request, attempt int, delay time.Duration) error {
+	t.enqueued += 1
+	t.attempt = attempt
+	t.deferred = delay
+
+	return nil
+}
+
+func (t *testQueue) Complete(ctx context.Context, r *Request) {
+	t.completed += 1
+}
+
+func (t *testQueue) DequeueRequest(ctx context.Context, skip []string) (r *Request, attempt int, err error) {
 	t.dequeued += 1
 
-	r = &Request{}
+	r = &Request{Meta: map[string]string{MetaDestination: t.destination}}
 	attempt = 2
 
 	return
@@ -65,9 +99,13 @@ func TestWork(t *testing.T) {
 	if sendCnt != 1 {
 		t.Errorf("should have sent the request")
 	}
+	if q.completed != 1 {
+		t.Errorf("should have completed the delivered request")
+	}
 
 	q.dequeued = 0
 	q.enqueued = 0
+	q.completed = 0
 
 	sendRequest = func(_ context.Context, r *Request) error {
 		return errors.New("any kind of error")
@@ -81,6 +119,9 @@ func TestWork(t *testing.T) {
 	if q.enqueued != 1 {
 		t.Errorf("should have enqueued the request again")
 	}
+	if q.completed != 0 {
+		t.Errorf("shouldn't complete the retried request")
+	}
 
 	worker.maxRetries = 1
 	q.dequeued = 0
@@ -92,4 +133,52 @@ func TestWork(t *testing.T) {
 	if sendCnt != 0 {
 		t.Errorf("shouldn't have sent the request with max attempts reached")
 	}
+	if q.completed != 1 {
+		t.Errorf("should have completed the dropped request")
+	}
+}
+
+func TestWorkPermanentError(t *testing.T) {
+	q := testQueue{}
+
+	worker := &Worker{
+		numWorkers: 1,
+		maxRetries: 10,
+		queue:      &q,
+		limiter:    rate.NewLimiter(rate.Limit(15), 15),
+	}
+
+	sendRequest := func(_ context.Context, r *Request) error {
+		return &PermanentError{Reason: "transform", Err: errors.New("invalid template")}
+	}
+
+	worker.Work(context.Background(), make(chan struct{}, 1), sendRequest)
+
+	if q.enqueued != 0 {
+		t.Errorf("shouldn't retry the request failing permanently")
+	}
+	if q.completed != 1 {
+		t.Errorf("should have completed the dropped request")
+	}
+}
+
+func TestTotal(t *testing.T) {
+	q := &testQueue{}
+	w := &Worker{queue: q}
+
+	// The first call starts counting in the background
+	w.Total()
+	for w.counting.Load() || q.totals.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		if total := w.Total(); total != 1 {
+			t.Fatalf("expected total 1, got %d", total)
+		}
+	}
+
+	if totals := q.totals.Load(); totals != 1 {
+		t.Errorf("expected the queue counted once, got %d", totals)
+	}
 }
@@ -39,7 +39,7 @@ func main() {
 
 	asyncProxy := proxy.NewProxy(cfg)
 
-	srv := server.NewServer(cfg, ctx)
+	srv := server.NewServer(cfg, ctx, asyncProxy.Queue())
 	srv.Mux.Handle("/", srv.MetricsMiddleware(asyncProxy))
 
 	asyncProxy.Start(ctx)
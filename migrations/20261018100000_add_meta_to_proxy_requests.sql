@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests ADD COLUMN meta varchar;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE proxy_requests DROP COLUMN meta;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests
+  ADD COLUMN header_format SMALLINT NOT NULL DEFAULT 0,
+  ADD COLUMN body_format SMALLINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE proxy_requests
+  DROP COLUMN header_format,
+  DROP COLUMN body_format;
+-- +goose StatementEnd
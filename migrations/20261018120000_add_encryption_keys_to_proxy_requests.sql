@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests
+  ADD COLUMN key_id varchar,
+  ADD COLUMN data_key varchar;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE proxy_requests
+  DROP COLUMN key_id,
+  DROP COLUMN data_key;
+-- +goose StatementEnd
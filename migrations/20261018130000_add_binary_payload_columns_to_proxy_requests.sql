@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests
+  ADD COLUMN header_data bytea,
+  ADD COLUMN body_data bytea,
+  ALTER COLUMN header DROP NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE proxy_requests
+  DROP COLUMN header_data,
+  DROP COLUMN body_data,
+  ALTER COLUMN header SET NOT NULL;
+-- +goose StatementEnd
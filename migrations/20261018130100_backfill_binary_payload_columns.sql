@@ -0,0 +1,59 @@
+-- Moves the payloads in batches committing each one, so the queue
+-- keeps working during the backfill. Encoded payloads are stored
+-- in base64 in the legacy columns and as is in the binary ones.
+
+-- +goose NO TRANSACTION
+
+-- +goose Up
+-- +goose StatementBegin
+DO $$
+DECLARE
+  updated integer;
+BEGIN
+  LOOP
+    UPDATE proxy_requests
+    SET
+      header_data = CASE
+        WHEN header_format = 0 THEN convert_to(header, 'UTF8')
+        ELSE decode(header, 'base64')
+      END,
+      body_data = CASE
+        WHEN body_format = 0 THEN convert_to(body, 'UTF8')
+        ELSE decode(body, 'base64')
+      END,
+      header = NULL,
+      body = NULL
+    WHERE id IN (
+      SELECT id FROM proxy_requests
+      WHERE header_data IS NULL AND header IS NOT NULL
+      LIMIT 1000
+      FOR UPDATE
+      SKIP LOCKED
+    );
+
+    GET DIAGNOSTICS updated = ROW_COUNT;
+    EXIT WHEN updated = 0;
+
+    COMMIT;
+  END LOOP;
+END
+$$;
+-- +goose StatementEnd
+
+-- Bodies with invalid UTF-8 can't be moved back
+-- +goose Down
+-- +goose StatementBegin
+UPDATE proxy_requests
+SET
+  header = CASE
+    WHEN header_format = 0 THEN convert_from(header_data, 'UTF8')
+    ELSE encode(header_data, 'base64')
+  END,
+  body = CASE
+    WHEN body_format = 0 THEN convert_from(body_data, 'UTF8')
+    ELSE encode(body_data, 'base64')
+  END,
+  header_data = NULL,
+  body_data = NULL
+WHERE header_data IS NOT NULL;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests ADD COLUMN tenant varchar NOT NULL DEFAULT '';
+
+CREATE INDEX proxy_requests_tenant_truncated_timestamp_idx
+ON proxy_requests (tenant, date_trunc('minute', timestamp));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX proxy_requests_tenant_truncated_timestamp_idx;
+
+ALTER TABLE proxy_requests DROP COLUMN tenant;
+-- +goose StatementEnd
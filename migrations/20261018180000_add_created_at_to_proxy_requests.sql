@@ -0,0 +1,18 @@
+-- Retried requests are enqueued again with the new timestamp, the first
+-- enqueue time is kept in created_at. The rows enqueued before have
+-- none, so their timestamp is used instead.
+
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests ADD COLUMN created_at timestamp without time zone;
+
+CREATE INDEX proxy_requests_created_at_idx
+ON proxy_requests ((COALESCE(created_at, timestamp)));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX proxy_requests_created_at_idx;
+
+ALTER TABLE proxy_requests DROP COLUMN created_at;
+-- +goose StatementEnd
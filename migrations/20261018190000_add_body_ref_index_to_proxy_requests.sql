@@ -0,0 +1,12 @@
+-- The blob garbage collection looks up the listed blobs by their keys
+
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX proxy_requests_body_ref_idx
+ON proxy_requests (body_ref) WHERE body_ref IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX proxy_requests_body_ref_idx;
+-- +goose StatementEnd
@@ -0,0 +1,77 @@
+-- Optional: partitions proxy_requests by the enqueue time. Apply with
+-- a separate version table while asyncproxy is stopped:
+--   goose -dir migrations/partitioning -table goose_partitioning_version postgres "..." up
+-- The existing table becomes the oldest partition and is dropped
+-- by asyncproxy once it's empty. Apply it after the main migrations,
+-- the indexes of the table are created on the partitioned one, so
+-- every new partition gets them.
+
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE proxy_requests RENAME TO proxy_requests_legacy;
+ALTER INDEX proxy_requests_pkey RENAME TO proxy_requests_legacy_pkey;
+ALTER INDEX proxy_requests_truncated_timestamp_idx RENAME TO proxy_requests_legacy_truncated_timestamp_idx;
+ALTER INDEX proxy_requests_tenant_truncated_timestamp_idx RENAME TO proxy_requests_legacy_tenant_truncated_timestamp_idx;
+ALTER INDEX proxy_requests_created_at_idx RENAME TO proxy_requests_legacy_created_at_idx;
+ALTER INDEX proxy_requests_body_ref_idx RENAME TO proxy_requests_legacy_body_ref_idx;
+
+CREATE TABLE proxy_requests (
+  LIKE proxy_requests_legacy INCLUDING DEFAULTS,
+  PRIMARY KEY (id, timestamp)
+) PARTITION BY RANGE (timestamp);
+
+CREATE INDEX proxy_requests_truncated_timestamp_idx
+ON proxy_requests (date_trunc('minute', timestamp));
+
+CREATE INDEX proxy_requests_tenant_truncated_timestamp_idx
+ON proxy_requests (tenant, date_trunc('minute', timestamp));
+
+CREATE INDEX proxy_requests_created_at_idx
+ON proxy_requests ((COALESCE(created_at, timestamp)));
+
+CREATE INDEX proxy_requests_body_ref_idx
+ON proxy_requests (body_ref) WHERE body_ref IS NOT NULL;
+
+-- Keeps the requests if there is no partition for them yet
+CREATE TABLE proxy_requests_default PARTITION OF proxy_requests DEFAULT;
+
+DO $$
+BEGIN
+  EXECUTE format(
+    'ALTER TABLE proxy_requests ATTACH PARTITION proxy_requests_legacy FOR VALUES FROM (MINVALUE) TO (%L)',
+    greatest(localtimestamp, (SELECT max(timestamp) FROM proxy_requests_legacy) + interval '1 microsecond')
+  );
+END
+$$;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE proxy_requests RENAME TO proxy_requests_partitioned;
+ALTER INDEX proxy_requests_pkey RENAME TO proxy_requests_partitioned_pkey;
+ALTER INDEX proxy_requests_truncated_timestamp_idx RENAME TO proxy_requests_partitioned_truncated_timestamp_idx;
+ALTER INDEX proxy_requests_tenant_truncated_timestamp_idx RENAME TO proxy_requests_partitioned_tenant_truncated_timestamp_idx;
+ALTER INDEX proxy_requests_created_at_idx RENAME TO proxy_requests_partitioned_created_at_idx;
+ALTER INDEX proxy_requests_body_ref_idx RENAME TO proxy_requests_partitioned_body_ref_idx;
+
+CREATE TABLE proxy_requests (
+  LIKE proxy_requests_partitioned INCLUDING DEFAULTS,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX proxy_requests_truncated_timestamp_idx
+ON proxy_requests (date_trunc('minute', timestamp));
+
+CREATE INDEX proxy_requests_tenant_truncated_timestamp_idx
+ON proxy_requests (tenant, date_trunc('minute', timestamp));
+
+CREATE INDEX proxy_requests_created_at_idx
+ON proxy_requests ((COALESCE(created_at, timestamp)));
+
+CREATE INDEX proxy_requests_body_ref_idx
+ON proxy_requests (body_ref) WHERE body_ref IS NOT NULL;
+
+INSERT INTO proxy_requests SELECT * FROM proxy_requests_partitioned;
+
+DROP TABLE proxy_requests_partitioned;
+-- +goose StatementEnd
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,6 +12,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/tlsconfig"
 	"github.com/evilmartians/asyncproxy/internal/worker"
 )
 
@@ -32,16 +34,16 @@ var (
 
 type Metrics struct {
 	server *http.Server
-	queue  worker.Queue
 }
 
 type httpHandler struct{}
 
-func NewMetrics(cfg *config.Config) *Metrics {
+// NewMetrics exports the stats of the queue owned by the workers
+func NewMetrics(cfg *config.Config, queue worker.Queue) *Metrics {
 	prometheusHandler = promhttp.Handler()
 	prometheusPath = cfg.Metrics.Path
 
-	queue, err := worker.NewPgQueue(cfg)
+	tlsConfig, err := tlsconfig.Server(cfg.Metrics.TLS)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -53,34 +55,31 @@ func NewMetrics(cfg *config.Config) *Metrics {
 		return float64(queue.Total())
 	})
 
+	if cfg.Tenants.Source != "" {
+		prometheus.MustRegister(newTenantQueueCollector(queue))
+	}
+
 	return &Metrics{
 		server: &http.Server{
 			Addr:         cfg.Metrics.Bind,
 			Handler:      httpHandler{},
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 5 * time.Second,
+			TLSConfig:    tlsConfig,
 		},
-		queue: queue,
 	}
 }
 
 func (m *Metrics) Start() {
 	go func() {
-		if err := m.server.ListenAndServe(); err != http.ErrServerClosed {
+		if err := listenAndServe(m.server); err != http.ErrServerClosed {
 			log.WithError(err).Warn("metrics error")
 		}
 	}()
 }
 
 func (m *Metrics) Shutdown(ctx context.Context) error {
-	err1 := m.server.Shutdown(ctx)
-	err2 := m.queue.Shutdown()
-
-	if err1 != nil {
-		return err1
-	}
-
-	return err2
+	return m.server.Shutdown(ctx)
 }
 
 func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -111,6 +110,68 @@ func handleMetrics(w http.ResponseWriter, r *http.Request) {
 	prometheusHandler.ServeHTTP(w, r)
 }
 
+var tenantQueueDesc = prometheus.NewDesc(
+	"queue_tenant_size",
+	"Number of requests in the queue by tenant.",
+	[]string{"tenant"}, nil,
+)
+
+// How often the requests of the tenants are counted
+const tenantTotalsInterval = 30 * time.Second
+
+// Counts the requests of the tenants in the background at most once
+// per tenantTotalsInterval, so the scrapes don't run GROUP BY on the
+// large queue
+type tenantQueueCollector struct {
+	queue worker.Queue
+
+	totals    atomic.Pointer[map[string]uint64]
+	countedAt atomic.Int64
+	counting  atomic.Bool
+}
+
+func newTenantQueueCollector(queue worker.Queue) *tenantQueueCollector {
+	c := &tenantQueueCollector{queue: queue}
+	c.count()
+
+	return c
+}
+
+func (c *tenantQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantQueueDesc
+}
+
+func (c *tenantQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	stale := time.Since(time.Unix(0, c.countedAt.Load())) >= tenantTotalsInterval
+	if stale && c.counting.CompareAndSwap(false, true) {
+		go func() {
+			defer c.counting.Store(false)
+			c.count()
+		}()
+	}
+
+	totals := c.totals.Load()
+	if totals == nil {
+		return
+	}
+
+	for tenant, cnt := range *totals {
+		ch <- prometheus.MustNewConstMetric(tenantQueueDesc, prometheus.GaugeValue, float64(cnt), tenant)
+	}
+}
+
+// The failed counts are retried on the next scrape
+func (c *tenantQueueCollector) count() {
+	totals, err := c.queue.TenantTotals()
+	if err != nil {
+		log.WithError(err).Warn("couldn't count tenant requests")
+		return
+	}
+
+	c.totals.Store(&totals)
+	c.countedAt.Store(time.Now().UnixNano())
+}
+
 func trackRequest(r *http.Request) {
 	requestsCounter.WithLabelValues(r.URL.Path).Inc()
 }
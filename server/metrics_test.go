@@ -0,0 +1,47 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/evilmartians/asyncproxy/internal/worker"
+)
+
+type tenantQueue struct {
+	worker.Queue
+
+	counts atomic.Int32
+}
+
+func (q *tenantQueue) TenantTotals() (map[string]uint64, error) {
+	q.counts.Add(1)
+	return map[string]uint64{"acme": 3}, nil
+}
+
+func TestTenantQueueCollector(t *testing.T) {
+	q := &tenantQueue{}
+	c := newTenantQueueCollector(q)
+
+	for i := 0; i < 10; i++ {
+		ch := make(chan prometheus.Metric, 1)
+		c.Collect(ch)
+
+		if len(ch) != 1 {
+			t.Fatalf("expected the tenant metric, got %d", len(ch))
+		}
+	}
+
+	if counts := q.counts.Load(); counts != 1 {
+		t.Errorf("expected the tenants counted once, got %d", counts)
+	}
+
+	// The stale counts are refreshed in the background
+	c.countedAt.Store(time.Now().Add(-tenantTotalsInterval).UnixNano())
+	c.Collect(make(chan prometheus.Metric, 1))
+	for c.counting.Load() || q.counts.Load() == 1 {
+		time.Sleep(time.Millisecond)
+	}
+}
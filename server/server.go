@@ -9,6 +9,8 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/evilmartians/asyncproxy/config"
+	"github.com/evilmartians/asyncproxy/internal/tlsconfig"
+	"github.com/evilmartians/asyncproxy/internal/worker"
 )
 
 type Server struct {
@@ -18,12 +20,18 @@ type Server struct {
 	metrics *Metrics
 }
 
-func NewServer(cfg *config.Config, ctx context.Context) Server {
+func NewServer(cfg *config.Config, ctx context.Context, queue worker.Queue) Server {
 	log.WithFields(log.Fields{
 		"bind":             cfg.Server.Bind,
 		"shutdown_timeout": cfg.Server.ShutdownTimeout,
+		"tls":              cfg.Server.TLS.CertFile != "",
 	}).Info("Initializing server")
 
+	tlsConfig, err := tlsconfig.Server(cfg.Server.TLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	mux := http.NewServeMux()
 
 	httpServer := &http.Server{
@@ -32,6 +40,7 @@ func NewServer(cfg *config.Config, ctx context.Context) Server {
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		BaseContext:  func(_ net.Listener) context.Context { return ctx },
+		TLSConfig:    tlsConfig,
 	}
 
 	httpServer.SetKeepAlivesEnabled(false)
@@ -39,14 +48,14 @@ func NewServer(cfg *config.Config, ctx context.Context) Server {
 	return Server{
 		Mux:     mux,
 		http:    httpServer,
-		metrics: NewMetrics(cfg),
+		metrics: NewMetrics(cfg, queue),
 	}
 }
 
 func (s Server) Start() {
 	s.metrics.Start()
 	go func() {
-		if err := s.http.ListenAndServe(); err != http.ErrServerClosed {
+		if err := listenAndServe(s.http); err != http.ErrServerClosed {
 			log.WithError(err).Warn("server error")
 		}
 	}()
@@ -69,3 +78,13 @@ func (s Server) Stop(ctx context.Context) {
 func (s Server) MetricsMiddleware(next http.Handler) http.Handler {
 	return s.metrics.Middleware(next)
 }
+
+// Serves HTTPS if the server has TLS configured
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		// Certificates are provided by the TLS config
+		return srv.ListenAndServeTLS("", "")
+	}
+
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,132 @@
+// Package signature signs the requests delivered by asyncproxy and
+// verifies them on the upstream side.
+//
+// The signature header looks like
+//
+//	X-Asyncproxy-Signature: t=1636040000,id=5f0c...,v1=9a3e...
+//
+// where t is the unix time of the delivery attempt, id is the request ID
+// kept across retries and v1 is the hex encoded HMAC-SHA256 of
+// "<t>.<id>.<body>" with the shared secret.
+//
+// Upstreams should check the timestamp tolerance to prevent replays and
+// may use the request ID to deduplicate retried deliveries:
+//
+//	id, err := signature.VerifyRequest(secret, signature.Header, r, 5*time.Minute)
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is the default signature header
+const Header = "X-Asyncproxy-Signature"
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpiredSignature = errors.New("signature timestamp is out of tolerance")
+)
+
+// Signer adds the signature header to the outgoing requests
+type Signer struct {
+	Secret []byte
+	Header string
+}
+
+// Sign sets the signature header of the request
+func (s *Signer) Sign(r *http.Request, requestID string, body []byte) {
+	header := s.Header
+	if header == "" {
+		header = Header
+	}
+
+	r.Header.Set(header, Sign(s.Secret, time.Now(), requestID, body))
+}
+
+// Sign returns the signature header value
+func Sign(secret []byte, timestamp time.Time, requestID string, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+
+	return "t=" + t + ",id=" + requestID + ",v1=" + compute(secret, t, requestID, body)
+}
+
+// Verify checks the signature header value and returns the request ID
+func Verify(secret []byte, value string, body []byte, tolerance time.Duration) (string, error) {
+	if value == "" {
+		return "", ErrMissingSignature
+	}
+
+	var t, id, v1 string
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return "", ErrInvalidSignature
+		}
+
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "id":
+			id = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return "", ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(v1), []byte(compute(secret, t, id, body))) {
+		return "", ErrInvalidSignature
+	}
+
+	if tolerance > 0 {
+		age := time.Since(time.Unix(unix, 0))
+		if age > tolerance || age < -tolerance {
+			return "", ErrExpiredSignature
+		}
+	}
+
+	return id, nil
+}
+
+// VerifyRequest verifies the request signed with the header, empty
+// for the default one. The request body is read and replaced, so it
+// can be read again.
+func VerifyRequest(secret []byte, header string, r *http.Request, tolerance time.Duration) (string, error) {
+	if header == "" {
+		header = Header
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return Verify(secret, r.Header.Get(header), body, tolerance)
+}
+
+func compute(secret []byte, t, id string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t + "." + id + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
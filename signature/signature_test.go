@@ -0,0 +1,70 @@
+package signature
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var secret = []byte("s3cr3t")
+
+func TestSignAndVerifyRequest(t *testing.T) {
+	body := []byte("<xml>payload</xml>")
+
+	r := httptest.NewRequest("POST", "/endpoint", bytes.NewReader(body))
+	(&Signer{Secret: secret}).Sign(r, "request-id", body)
+
+	id, err := VerifyRequest(secret, "", r, time.Minute)
+	if err != nil {
+		t.Fatalf("expected signature to be valid: %s", err)
+	}
+	if id != "request-id" {
+		t.Errorf("expected request ID: %s != request-id", id)
+	}
+
+	restored, _ := io.ReadAll(r.Body)
+	if !bytes.Equal(restored, body) {
+		t.Errorf("expected body to be readable again: %s", restored)
+	}
+}
+
+func TestVerifyRequestCustomHeader(t *testing.T) {
+	body := []byte("payload")
+
+	r := httptest.NewRequest("POST", "/endpoint", bytes.NewReader(body))
+	(&Signer{Secret: secret, Header: "X-Signature"}).Sign(r, "request-id", body)
+
+	if _, err := VerifyRequest(secret, "", r, time.Minute); err != ErrMissingSignature {
+		t.Errorf("expected default header to be missing: %v", err)
+	}
+	if _, err := VerifyRequest(secret, "X-Signature", r, time.Minute); err != nil {
+		t.Errorf("expected custom header to be verified: %s", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte("payload")
+	now := time.Now()
+
+	if _, err := Verify(secret, "", body, 0); err != ErrMissingSignature {
+		t.Errorf("expected missing signature error: %v", err)
+	}
+
+	value := Sign(secret, now, "id", body)
+	if _, err := Verify(secret, value, []byte("tampered"), time.Minute); err != ErrInvalidSignature {
+		t.Errorf("expected tampered body to be rejected: %v", err)
+	}
+	if _, err := Verify([]byte("other"), value, body, time.Minute); err != ErrInvalidSignature {
+		t.Errorf("expected other secret to be rejected: %v", err)
+	}
+
+	value = Sign(secret, now.Add(-time.Hour), "id", body)
+	if _, err := Verify(secret, value, body, time.Minute); err != ErrExpiredSignature {
+		t.Errorf("expected old signature to be rejected: %v", err)
+	}
+	if _, err := Verify(secret, value, body, 0); err != nil {
+		t.Errorf("expected old signature to pass without tolerance: %s", err)
+	}
+}